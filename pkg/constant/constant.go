@@ -10,4 +10,30 @@ const (
 	ServiceProxyName = "cluster-proxy-service-proxy"
 
 	AddonName = "cluster-proxy"
+
+	// ManagedProxyConfigurationName is the name of the ManagedProxyConfiguration of cluster-proxy.
+	ManagedProxyConfigurationName = "cluster-proxy"
+
+	// AnnotationAgentIdentifierStrategy and AnnotationAgentIdentifierClaim set on the ManagedProxyConfiguration tell how the
+	// proxy-agents are registered, the chart sets the strategy of cluster-proxy and the user-server checks them at startup.
+	AnnotationAgentIdentifierStrategy = "cluster-proxy.open-cluster-management.io/agent-identifier-strategy"
+	AnnotationAgentIdentifierClaim    = "cluster-proxy.open-cluster-management.io/agent-identifier-claim"
+
+	// LabelLocalCluster is set to true on the ManagedCluster of the hub itself.
+	LabelLocalCluster = "local-cluster"
+
+	// AnnotationRateLimitQPS and AnnotationRateLimitBurst set on the cluster-proxy ManagedClusterAddOn of a cluster
+	// override the default rate limit of the requests proxied to the cluster by the user-server.
+	AnnotationRateLimitQPS   = "cluster-proxy.open-cluster-management.io/rate-limit-qps"
+	AnnotationRateLimitBurst = "cluster-proxy.open-cluster-management.io/rate-limit-burst"
+
+	// AnnotationServiceCABundle set on a Service of the managed cluster references the ConfigMap, <name> or
+	// <name>/<key>, of the CA bundle the service-proxy verifies the service with, instead of its default root CAs.
+	// AnnotationServiceServerName overrides the server name the service-proxy verifies and sends in the SNI.
+	AnnotationServiceCABundle   = "cluster-proxy.open-cluster-management.io/ca-bundle"
+	AnnotationServiceServerName = "cluster-proxy.open-cluster-management.io/server-name"
+
+	// AnnotationServiceClientCertificate set on a Service of the managed cluster references the kubernetes.io/tls
+	// Secret, in the namespace of the Service, of the client certificate the service-proxy presents to the service.
+	AnnotationServiceClientCertificate = "cluster-proxy.open-cluster-management.io/client-certificate-secret"
 )
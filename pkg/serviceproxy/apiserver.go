@@ -0,0 +1,245 @@
+package serviceproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// inClusterAPIServerHost is the host of the target URL of the requests to the kube-apiserver.
+	inClusterAPIServerHost = "kubernetes.default.svc"
+
+	serviceAccountTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+)
+
+// externalAPIServer is the kube-apiserver of a managed cluster when the service-proxy does not run on it,
+// e.g. when the control plane of the managed cluster is hosted on another cluster. The requests to the
+// kube-apiserver are proxied to the server of the kubeconfig, and the credentials of the kubeconfig are
+// used to review the tokens and to impersonate the hub users.
+type externalAPIServer struct {
+	client *kubeconfigClient
+
+	upstream atomic.Pointer[apiServerUpstream]
+}
+
+// apiServerUpstream is how the kube-apiserver is reached with a rest config.
+type apiServerUpstream struct {
+	config *rest.Config
+	url    *url.URL
+	// anonymous trusts the kube-apiserver without presenting the client certificate of the kubeconfig, the
+	// managed cluster users are authenticated by their own token
+	anonymous *tls.Config
+	// authenticated presents the client certificate of the kubeconfig, if any, to impersonate the hub users
+	authenticated *tls.Config
+}
+
+// newExternalAPIServer loads the kubeconfig, the name identifies it in the logs.
+func newExternalAPIServer(name, kubeconfig string) (*externalAPIServer, error) {
+	client, err := newKubeconfigClient(name, kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	a := &externalAPIServer{client: client}
+	if _, err := a.get(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// get returns the upstream of the last valid kubeconfig, it is rebuilt when the kubeconfig is reloaded.
+func (a *externalAPIServer) get() (*apiServerUpstream, error) {
+	config := a.client.restConfig()
+	if upstream := a.upstream.Load(); upstream != nil && upstream.config == config {
+		return upstream, nil
+	}
+
+	if config.ExecProvider != nil || config.AuthProvider != nil {
+		return nil, fmt.Errorf("the apiserver kubeconfig must use a token or a client certificate, exec and auth providers are not supported")
+	}
+	serverURL, err := url.Parse(config.Host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server %q in the apiserver kubeconfig: %v", config.Host, err)
+	}
+	if serverURL.Scheme != "https" {
+		return nil, fmt.Errorf("the server %q of the apiserver kubeconfig must be https", config.Host)
+	}
+	anonymous, err := rest.TLSConfigFor(rest.AnonymousClientConfig(config))
+	if err != nil {
+		return nil, err
+	}
+	authenticated, err := rest.TLSConfigFor(config)
+	if err != nil {
+		return nil, err
+	}
+
+	upstream := &apiServerUpstream{
+		config:        config,
+		url:           serverURL,
+		anonymous:     withDefaultTLSConfig(anonymous),
+		authenticated: withDefaultTLSConfig(authenticated),
+	}
+	a.upstream.Store(upstream)
+	return upstream, nil
+}
+
+// token returns the bearer token of the kubeconfig, it is empty if the kubeconfig uses a client certificate.
+func (u *apiServerUpstream) token() (string, error) {
+	// the token file is read when the kubeconfig is loaded, and the kubeconfig is reloaded when it changes
+	if u.config.BearerToken != "" {
+		return strings.TrimSpace(u.config.BearerToken), nil
+	}
+	if u.config.BearerTokenFile == "" {
+		return "", nil
+	}
+	token, err := os.ReadFile(u.config.BearerTokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// withDefaultTLSConfig returns a TLS config trusting the system CAs if the kubeconfig sets no TLS option.
+func withDefaultTLSConfig(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.MinVersion < tls.VersionTLS12 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	return config
+}
+
+// parseAPIServerBackend parses the value of the --apiserver flag, a comma-separated list of key=value pairs:
+// cluster and kubeconfig.
+func parseAPIServerBackend(value string) (cluster, kubeconfig string, err error) {
+	for _, pair := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return "", "", fmt.Errorf("invalid apiserver %q: %q is not a key=value pair", value, pair)
+		}
+		switch key {
+		case "cluster":
+			cluster = val
+		case "kubeconfig":
+			kubeconfig = val
+		default:
+			return "", "", fmt.Errorf("invalid apiserver %q: unknown key %q", value, key)
+		}
+	}
+
+	if cluster == "" {
+		return "", "", fmt.Errorf("invalid apiserver %q: the cluster is required", value)
+	}
+	if kubeconfig == "" {
+		return "", "", fmt.Errorf("invalid apiserver %q: the kubeconfig is required", value)
+	}
+	return cluster, kubeconfig, nil
+}
+
+// apiServerBackends loads the kube-apiservers of --apiserver by the name of their cluster.
+func (s *serviceProxy) apiServerBackends() (map[string]*externalAPIServer, error) {
+	backends := map[string]*externalAPIServer{}
+	for _, value := range s.apiServerBackendValues {
+		cluster, kubeconfig, err := parseAPIServerBackend(value)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := backends[cluster]; ok || cluster == s.clusterName {
+			return nil, fmt.Errorf("the kube-apiserver of the cluster %q is set more than once", cluster)
+		}
+		if backends[cluster], err = newExternalAPIServer("apiserver-"+cluster, kubeconfig); err != nil {
+			return nil, fmt.Errorf("failed to load the apiserver kubeconfig of the cluster %s: %v", cluster, err)
+		}
+	}
+	return backends, nil
+}
+
+// apiServerFor returns the kube-apiserver of the cluster, nil for the kube-apiserver of the in-cluster config.
+// Once kube-apiservers are registered by --apiserver, the default kube-apiserver only serves --cluster-name,
+// so that the requests for an unknown cluster are not sent to the kube-apiserver of another cluster.
+func (s *serviceProxy) apiServerFor(cluster string) (*externalAPIServer, error) {
+	if backend, ok := s.apiServerBackendsByCluster[cluster]; ok {
+		return backend, nil
+	}
+	if len(s.apiServerBackendsByCluster) > 0 && (cluster == "" || cluster != s.clusterName) {
+		return nil, fmt.Errorf("no kube-apiserver is registered for the cluster %q", cluster)
+	}
+	return s.externalAPIServer, nil
+}
+
+// checkAPIServers is a health check failing if the credentials of an apiserver kubeconfig are invalid.
+func (s *serviceProxy) checkAPIServers(req *http.Request) error {
+	if s.externalAPIServer != nil {
+		if err := s.externalAPIServer.client.check(req); err != nil {
+			return err
+		}
+	}
+	for cluster, backend := range s.apiServerBackendsByCluster {
+		if err := backend.client.check(req); err != nil {
+			return fmt.Errorf("cluster %s: %v", cluster, err)
+		}
+	}
+	return nil
+}
+
+// runAPIServers reloads the apiserver kubeconfigs until the context is done.
+func (s *serviceProxy) runAPIServers(ctx context.Context) {
+	if s.externalAPIServer != nil {
+		go s.externalAPIServer.client.run(ctx)
+	}
+	for _, backend := range s.apiServerBackendsByCluster {
+		go backend.client.run(ctx)
+	}
+}
+
+// managedClusterClient returns the client reviewing the tokens of the users of the kube-apiserver.
+func (s *serviceProxy) managedClusterClient(backend *externalAPIServer) kubernetes.Interface {
+	if backend != nil {
+		return backend.client.get()
+	}
+	return s.managedClusterKubeClient
+}
+
+// apiServerTarget returns the URL and the TLS config the requests to the kube-apiserver are proxied with,
+// impersonated tells whether the request impersonates a hub user.
+func (s *serviceProxy) apiServerTarget(backend *externalAPIServer, target *url.URL, impersonated bool) (*url.URL, *tls.Config, error) {
+	if backend == nil {
+		return target, &tls.Config{RootCAs: s.rootCAs.Pool(), MinVersion: tls.VersionTLS12}, nil
+	}
+	upstream, err := backend.get()
+	if err != nil {
+		return nil, nil, err
+	}
+	if impersonated {
+		return upstream.url, upstream.authenticated, nil
+	}
+	return upstream.url, upstream.anonymous, nil
+}
+
+// getImpersonateToken returns the token with the impersonate permission on the kube-apiserver, it is empty
+// if the client certificate of the apiserver kubeconfig is presented instead.
+func (s *serviceProxy) getImpersonateToken(backend *externalAPIServer) (string, error) {
+	if backend != nil {
+		upstream, err := backend.get()
+		if err != nil {
+			return "", err
+		}
+		return upstream.token()
+	}
+
+	// Read the latest token from the mounted file
+	token, err := os.ReadFile(serviceAccountTokenFile)
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
@@ -0,0 +1,251 @@
+package serviceproxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/client-go/util/cert"
+)
+
+func TestExternalAPIServer(t *testing.T) {
+	certPEM, keyPEM, err := cert.GenerateSelfSignedCertKey("hosted-apiserver", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		name              string
+		server            string
+		user              string
+		expectErr         bool
+		expectToken       string
+		expectClientCerts bool
+	}{
+		{
+			name:        "token",
+			server:      "https://api.hosted.example.com:6443",
+			user:        "token: inline-token",
+			expectToken: "inline-token",
+		},
+		{
+			name:        "token file",
+			server:      "https://api.hosted.example.com:6443",
+			user:        "tokenFile: " + tokenFile,
+			expectToken: "file-token",
+		},
+		{
+			name:   "client certificate",
+			server: "https://api.hosted.example.com:6443",
+			user: fmt.Sprintf("client-certificate-data: %s\n    client-key-data: %s",
+				base64.StdEncoding.EncodeToString(certPEM), base64.StdEncoding.EncodeToString(keyPEM)),
+			expectClientCerts: true,
+		},
+		{
+			name:      "exec provider",
+			server:    "https://api.hosted.example.com:6443",
+			user:      "exec:\n      apiVersion: client.authentication.k8s.io/v1\n      command: get-token",
+			expectErr: true,
+		},
+		{
+			name:      "http server",
+			server:    "http://api.hosted.example.com:6443",
+			user:      "token: inline-token",
+			expectErr: true,
+		},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.name, func(t *testing.T) {
+			kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+			content := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: hosted
+  cluster:
+    server: %s
+    certificate-authority-data: %s
+users:
+- name: hosted
+  user:
+    %s
+contexts:
+- name: hosted
+  context:
+    cluster: hosted
+    user: hosted
+current-context: hosted
+`, c.server, base64.StdEncoding.EncodeToString(certPEM), c.user)
+			if err := os.WriteFile(kubeconfig, []byte(content), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			apiServer, err := newExternalAPIServer("apiserver", kubeconfig)
+			if c.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			upstream, err := apiServer.get()
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if upstream.url.String() != c.server {
+				t.Errorf("expected url %s, got %s", c.server, upstream.url)
+			}
+			token, err := upstream.token()
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if token != c.expectToken {
+				t.Errorf("expected token %q, got %q", c.expectToken, token)
+			}
+			if upstream.anonymous.RootCAs == nil || upstream.authenticated.RootCAs == nil {
+				t.Errorf("expected the CA of the kubeconfig to be trusted")
+			}
+			if upstream.anonymous.GetClientCertificate != nil || len(upstream.anonymous.Certificates) != 0 {
+				t.Errorf("expected no client certificate to be presented for the managed cluster users")
+			}
+			hasClientCerts := upstream.authenticated.GetClientCertificate != nil || len(upstream.authenticated.Certificates) != 0
+			if hasClientCerts != c.expectClientCerts {
+				t.Errorf("expected client certificate %v, got %v", c.expectClientCerts, hasClientCerts)
+			}
+		})
+	}
+}
+
+func TestParseAPIServerBackend(t *testing.T) {
+	testcases := []struct {
+		name             string
+		value            string
+		expectCluster    string
+		expectKubeconfig string
+		expectErr        bool
+	}{
+		{
+			name:             "valid",
+			value:            "cluster=hosted-1, kubeconfig=/var/run/hosted-1/kubeconfig",
+			expectCluster:    "hosted-1",
+			expectKubeconfig: "/var/run/hosted-1/kubeconfig",
+		},
+		{
+			name:      "missing cluster",
+			value:     "kubeconfig=/var/run/hosted-1/kubeconfig",
+			expectErr: true,
+		},
+		{
+			name:      "missing kubeconfig",
+			value:     "cluster=hosted-1",
+			expectErr: true,
+		},
+		{
+			name:      "unknown key",
+			value:     "cluster=hosted-1,kubeconfig=/var/run/hosted-1/kubeconfig,namespace=hosted-1",
+			expectErr: true,
+		},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.name, func(t *testing.T) {
+			cluster, kubeconfig, err := parseAPIServerBackend(c.value)
+			if c.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if cluster != c.expectCluster || kubeconfig != c.expectKubeconfig {
+				t.Errorf("expected %s and %s, got %s and %s", c.expectCluster, c.expectKubeconfig, cluster, kubeconfig)
+			}
+		})
+	}
+}
+
+func TestAPIServerFor(t *testing.T) {
+	defaultAPIServer := &externalAPIServer{}
+	hosted := &externalAPIServer{}
+
+	testcases := []struct {
+		name        string
+		clusterName string
+		backends    map[string]*externalAPIServer
+		cluster     string
+		expect      *externalAPIServer
+		expectErr   bool
+	}{
+		{
+			name:    "no backend",
+			cluster: "cluster1",
+			expect:  defaultAPIServer,
+		},
+		{
+			name:    "no backend and no cluster",
+			cluster: "",
+			expect:  defaultAPIServer,
+		},
+		{
+			name:     "registered backend",
+			backends: map[string]*externalAPIServer{"hosted-1": hosted},
+			cluster:  "hosted-1",
+			expect:   hosted,
+		},
+		{
+			name:        "default cluster",
+			clusterName: "hosting",
+			backends:    map[string]*externalAPIServer{"hosted-1": hosted},
+			cluster:     "hosting",
+			expect:      defaultAPIServer,
+		},
+		{
+			name:        "unknown cluster",
+			clusterName: "hosting",
+			backends:    map[string]*externalAPIServer{"hosted-1": hosted},
+			cluster:     "hosted-2",
+			expectErr:   true,
+		},
+		{
+			name:      "no cluster",
+			backends:  map[string]*externalAPIServer{"hosted-1": hosted},
+			cluster:   "",
+			expectErr: true,
+		},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.name, func(t *testing.T) {
+			s := &serviceProxy{
+				externalAPIServer:          defaultAPIServer,
+				clusterName:                c.clusterName,
+				apiServerBackendsByCluster: c.backends,
+			}
+			backend, err := s.apiServerFor(c.cluster)
+			if c.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if backend != c.expect {
+				t.Errorf("expected backend %p, got %p", c.expect, backend)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package serviceproxy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/stolostron/cluster-proxy-addon/pkg/utils"
+	"k8s.io/klog/v2"
+)
+
+var errNotAuthenticated = errors.New("authentication failed: token is neither valid for managed cluster nor hub cluster")
+
+// setForwardedUser sets the header of the authenticated user, --forwarded-user-header, on the requests to the
+// services, for the apps which trust the proxy to authenticate their users, like the ones behind oauth-proxy.
+// The header sent by the client is always removed, and it is only set once the token of the request is
+// authenticated by the managed cluster or a hub. The requests without token, or with a token neither of them
+// authenticates, e.g. a token of the service itself, are forwarded without it, as are the requests whose token
+// can not be reviewed: the service authenticates them as it would without the header.
+func (s *serviceProxy) setForwardedUser(req *http.Request) {
+	if s.forwardedUserHeader == "" {
+		return
+	}
+	req.Header.Del(s.forwardedUserHeader)
+
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+		return
+	}
+	requestID := req.Header.Get(utils.HeaderRequestID)
+	// the token is reviewed by the kube-apiserver of the target cluster, as for the requests to the kube-apiserver
+	backend, err := s.apiServerFor(utils.GetTargetClusterFromRequest(req))
+	if err != nil {
+		klog.V(2).InfoS("forward the request without user", "requestID", requestID, "reason", err)
+		return
+	}
+	hub, userInfo, err := s.authenticate(req, backend)
+	if errors.Is(err, errNotAuthenticated) {
+		return
+	}
+	if err != nil {
+		klog.ErrorS(err, "failed to authenticate the forwarded user, forward the request without user", "requestID", requestID)
+		return
+	}
+
+	username := userInfo.Username
+	if hub != nil {
+		username = hub.username(userInfo)
+		authenticationsTotal.WithLabelValues(authResultHubToken).Inc()
+	} else {
+		authenticationsTotal.WithLabelValues(authResultManagedToken).Inc()
+	}
+	klog.V(2).InfoS("forward the authenticated user", "requestID", requestID, "user", username)
+	req.Header.Set(s.forwardedUserHeader, username)
+}
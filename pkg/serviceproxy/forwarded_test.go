@@ -0,0 +1,108 @@
+package serviceproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestSetForwardedUser(t *testing.T) {
+	// the kube-apiserver of the managed cluster, which authenticates the token "valid" only
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		review := &authenticationv1.TokenReview{}
+		if err := json.NewDecoder(r.Body).Decode(review); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		switch review.Spec.Token {
+		case "valid":
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "alice"}}
+		case "error":
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(review)
+	}))
+	defer apiServer.Close()
+
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: apiServer.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		name    string
+		header  string
+		token   string
+		cluster string
+		spoofed string
+		expect  string
+	}{
+		{
+			name:    "disabled",
+			token:   "valid",
+			spoofed: "admin",
+			expect:  "admin",
+		},
+		{
+			name:   "authenticated",
+			header: "X-Forwarded-User",
+			token:  "valid",
+			expect: "alice",
+		},
+		{
+			name:    "spoofed",
+			header:  "X-Forwarded-User",
+			spoofed: "admin",
+		},
+		{
+			name:    "not authenticated",
+			header:  "X-Forwarded-User",
+			token:   "token-of-the-service",
+			spoofed: "admin",
+		},
+		{
+			name:    "review error",
+			header:  "X-Forwarded-User",
+			token:   "error",
+			spoofed: "admin",
+		},
+		{
+			name:    "unregistered cluster",
+			header:  "X-Forwarded-User",
+			token:   "valid",
+			cluster: "hosted-1",
+			spoofed: "admin",
+		},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.name, func(t *testing.T) {
+			s := &serviceProxy{forwardedUserHeader: c.header, managedClusterKubeClient: client}
+			req := httptest.NewRequest(http.MethodGet, "https://cluster-proxy-service-proxy:7443/dashboard", nil)
+			if c.token != "" {
+				req.Header.Set("Authorization", "Bearer "+c.token)
+			}
+			if c.spoofed != "" {
+				req.Header.Set("X-Forwarded-User", c.spoofed)
+			}
+
+			if c.cluster != "" {
+				// only the kube-apiserver of another cluster is registered
+				s.apiServerBackendsByCluster = map[string]*externalAPIServer{"hosted-2": {}}
+				req.Header.Set("Cluster-Proxy-Cluster", c.cluster)
+			}
+
+			s.setForwardedUser(req)
+			if actual := req.Header.Get("X-Forwarded-User"); actual != c.expect {
+				t.Errorf("expected %q, got %q", c.expect, actual)
+			}
+		})
+	}
+}
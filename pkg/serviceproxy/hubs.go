@@ -0,0 +1,212 @@
+package serviceproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+// the scopes of the identity prefix of a hub.
+const (
+	// identityPrefixServiceAccounts prefixes the username of the serviceaccounts only.
+	identityPrefixServiceAccounts = "serviceaccounts"
+	// identityPrefixAll prefixes the username of all the users and their groups.
+	identityPrefixAll = "all"
+)
+
+// trustedHub is a hub whose users are authenticated by the service-proxy.
+type trustedHub struct {
+	name string
+	// identityPrefix is prefixed to the identity of the users of the hub when they are impersonated, so
+	// that they can not be mistaken for the users of the managed cluster or of another hub.
+	identityPrefix string
+	// identityPrefixScope tells which identities are prefixed, identityPrefixServiceAccounts or identityPrefixAll
+	identityPrefixScope string
+	// issuer is the issuer of the JWT tokens of the hub, the JWT tokens of another issuer are not sent to it
+	issuer     string
+	kubeconfig string
+	enabled    bool
+
+	client *kubeconfigClient
+}
+
+// username returns the username of the user of the hub as seen on the managed cluster, the serviceaccounts of
+// the hub, or all its users, have its identity prefix, "cluster:hub:" by default.
+func (h *trustedHub) username(userInfo *authenticationv1.UserInfo) string {
+	if h.identityPrefixScope == identityPrefixAll || isServiceAccountUser(userInfo) {
+		return h.identityPrefix + userInfo.Username
+	}
+	return userInfo.Username
+}
+
+// groups returns the groups of the user of the hub as seen on the managed cluster, they have the identity
+// prefix of the hub if all its users do.
+func (h *trustedHub) groups(userInfo *authenticationv1.UserInfo) []string {
+	if h.identityPrefixScope != identityPrefixAll {
+		return userInfo.Groups
+	}
+	groups := make([]string, 0, len(userInfo.Groups))
+	for _, group := range userInfo.Groups {
+		groups = append(groups, h.identityPrefix+group)
+	}
+	return groups
+}
+
+func isServiceAccountUser(userInfo *authenticationv1.UserInfo) bool {
+	return strings.HasPrefix(userInfo.Username, "system:serviceaccount:")
+}
+
+func defaultIdentityPrefix(name string) string {
+	return fmt.Sprintf("cluster:%s:", name)
+}
+
+// parseTrustedHub parses the value of the --hub flag, a comma-separated list of key=value pairs:
+// name, kubeconfig, identity-prefix (default cluster:<name>:), identity-prefix-scope (default all),
+// issuer and enabled (default true).
+func parseTrustedHub(value string) (*trustedHub, error) {
+	hub := &trustedHub{identityPrefixScope: identityPrefixAll, enabled: true}
+	for _, pair := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid hub %q: %q is not a key=value pair", value, pair)
+		}
+		switch key {
+		case "name":
+			hub.name = val
+		case "kubeconfig":
+			hub.kubeconfig = val
+		case "identity-prefix":
+			hub.identityPrefix = val
+		case "identity-prefix-scope":
+			if val != identityPrefixServiceAccounts && val != identityPrefixAll {
+				return nil, fmt.Errorf("invalid hub %q: the identity-prefix-scope must be %s or %s", value, identityPrefixServiceAccounts, identityPrefixAll)
+			}
+			hub.identityPrefixScope = val
+		case "issuer":
+			hub.issuer = val
+		case "enabled":
+			enabled, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, fmt.Errorf("invalid hub %q: %v", value, err)
+			}
+			hub.enabled = enabled
+		default:
+			return nil, fmt.Errorf("invalid hub %q: unknown key %q", value, key)
+		}
+	}
+
+	if hub.name == "" {
+		return nil, fmt.Errorf("invalid hub %q: the name is required", value)
+	}
+	if hub.kubeconfig == "" {
+		return nil, fmt.Errorf("invalid hub %q: the kubeconfig is required", value)
+	}
+	if hub.identityPrefix == "" {
+		hub.identityPrefix = defaultIdentityPrefix(hub.name)
+	}
+	return hub, nil
+}
+
+// trustedHubs returns the enabled hubs, in the order their users are authenticated: the hub of
+// --hub-kubeconfig first, then the hubs of --hub.
+func (s *serviceProxy) trustedHubs() ([]*trustedHub, error) {
+	hubs := []*trustedHub{}
+	if s.hubKubeConfig != "" {
+		// only its serviceaccounts are prefixed, so that the existing bindings of its users are unchanged
+		hubs = append(hubs, &trustedHub{
+			name:                s.hubName,
+			identityPrefix:      s.hubIdentityPrefix,
+			identityPrefixScope: identityPrefixServiceAccounts,
+			issuer:              s.hubIssuer,
+			kubeconfig:          s.hubKubeConfig,
+			enabled:             true,
+		})
+	}
+	for _, value := range s.additionalHubs {
+		hub, err := parseTrustedHub(value)
+		if err != nil {
+			return nil, err
+		}
+		hubs = append(hubs, hub)
+	}
+
+	names := map[string]bool{}
+	enabled := []*trustedHub{}
+	for _, hub := range hubs {
+		if names[hub.name] {
+			return nil, fmt.Errorf("the hub name %q is not unique", hub.name)
+		}
+		names[hub.name] = true
+		if hub.enabled {
+			enabled = append(enabled, hub)
+		}
+	}
+	return enabled, nil
+}
+
+// hubsForToken returns the hubs the token is reviewed by, in turn. A JWT token is only sent to the hubs of its
+// issuer, and to the hubs whose issuer is not set if none is, so that the tokens of a hub are not presented to
+// the others. The other tokens, e.g. the OAuth tokens of OpenShift, tell nothing about their hub and are sent
+// to all the hubs.
+func (s *serviceProxy) hubsForToken(token string) []*trustedHub {
+	issuer := tokenIssuer(token)
+	if issuer == "" {
+		return s.hubs
+	}
+	issued, unknown := []*trustedHub{}, []*trustedHub{}
+	for _, hub := range s.hubs {
+		switch hub.issuer {
+		case issuer:
+			issued = append(issued, hub)
+		case "":
+			unknown = append(unknown, hub)
+		}
+	}
+	if len(issued) > 0 {
+		return issued
+	}
+	return unknown
+}
+
+// tokenIssuer returns the iss claim of a JWT token, empty if the token is not a JWT. The signature is not
+// verified, the issuer only picks the hub which reviews the token.
+func tokenIssuer(token string) string {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+	claims := struct {
+		Issuer string `json:"iss"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+	return claims.Issuer
+}
+
+// checkHubs is a health check failing if the credentials of a hub are invalid.
+func (s *serviceProxy) checkHubs(req *http.Request) error {
+	for _, hub := range s.hubs {
+		if err := hub.client.check(req); err != nil {
+			return fmt.Errorf("hub %s: %v", hub.name, err)
+		}
+	}
+	return nil
+}
+
+// runHubs reloads the clients of the hubs until the context is done.
+func (s *serviceProxy) runHubs(ctx context.Context) {
+	for _, hub := range s.hubs {
+		go hub.client.run(ctx)
+	}
+}
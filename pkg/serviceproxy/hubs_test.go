@@ -0,0 +1,191 @@
+package serviceproxy
+
+import (
+	"encoding/base64"
+	"reflect"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+)
+
+func TestParseTrustedHub(t *testing.T) {
+	testcases := []struct {
+		name      string
+		value     string
+		expect    *trustedHub
+		expectErr bool
+	}{
+		{
+			name:  "defaults",
+			value: "name=hub-b,kubeconfig=/var/run/hub-b/kubeconfig",
+			expect: &trustedHub{
+				name:                "hub-b",
+				kubeconfig:          "/var/run/hub-b/kubeconfig",
+				identityPrefix:      "cluster:hub-b:",
+				identityPrefixScope: identityPrefixAll,
+				enabled:             true,
+			},
+		},
+		{
+			name:  "all keys",
+			value: "name=hub-b, kubeconfig=/var/run/hub-b/kubeconfig, identity-prefix=cluster:backup:, identity-prefix-scope=serviceaccounts, issuer=https://hub-b.example.com, enabled=false",
+			expect: &trustedHub{
+				name:                "hub-b",
+				kubeconfig:          "/var/run/hub-b/kubeconfig",
+				identityPrefix:      "cluster:backup:",
+				identityPrefixScope: identityPrefixServiceAccounts,
+				issuer:              "https://hub-b.example.com",
+				enabled:             false,
+			},
+		},
+		{
+			name:      "missing kubeconfig",
+			value:     "name=hub-b",
+			expectErr: true,
+		},
+		{
+			name:      "unknown key",
+			value:     "name=hub-b,kubeconfig=/kubeconfig,prefix=cluster:b:",
+			expectErr: true,
+		},
+		{
+			name:      "invalid identity prefix scope",
+			value:     "name=hub-b,kubeconfig=/kubeconfig,identity-prefix-scope=users",
+			expectErr: true,
+		},
+		{
+			name:      "invalid enabled",
+			value:     "name=hub-b,kubeconfig=/kubeconfig,enabled=maybe",
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		hub, err := parseTrustedHub(tc.value)
+		if tc.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(hub, tc.expect) {
+			t.Errorf("%s: expected %+v, got %+v", tc.name, tc.expect, hub)
+		}
+	}
+}
+
+func TestTrustedHubs(t *testing.T) {
+	s := &serviceProxy{
+		hubKubeConfig:     "/var/run/hub/kubeconfig",
+		hubName:           "hub",
+		hubIdentityPrefix: "cluster:hub:",
+		additionalHubs: []string{
+			"name=hub-b,kubeconfig=/var/run/hub-b/kubeconfig",
+			"name=hub-c,kubeconfig=/var/run/hub-c/kubeconfig,enabled=false",
+		},
+	}
+	hubs, err := s.trustedHubs()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	names := []string{}
+	for _, hub := range hubs {
+		names = append(names, hub.name)
+	}
+	if !reflect.DeepEqual(names, []string{"hub", "hub-b"}) {
+		t.Errorf("expected the enabled hubs in order, got %v", names)
+	}
+
+	s.additionalHubs = append(s.additionalHubs, "name=hub,kubeconfig=/var/run/other/kubeconfig")
+	if _, err := s.trustedHubs(); err == nil {
+		t.Errorf("expected an error for a duplicated hub name")
+	}
+}
+
+func TestTrustedHubIdentities(t *testing.T) {
+	s := &serviceProxy{
+		hubKubeConfig:     "/var/run/hub/kubeconfig",
+		hubName:           "hub",
+		hubIdentityPrefix: "cluster:hub:",
+		additionalHubs: []string{
+			"name=hub-b,kubeconfig=/var/run/hub-b/kubeconfig",
+			"name=hub-c,kubeconfig=/var/run/hub-c/kubeconfig",
+		},
+	}
+	hubs, err := s.trustedHubs()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	user := &authenticationv1.UserInfo{Username: "alice", Groups: []string{"admins"}}
+	serviceAccount := &authenticationv1.UserInfo{Username: "system:serviceaccount:default:app", Groups: []string{"system:serviceaccounts"}}
+	expects := map[string]struct {
+		user           string
+		groups         []string
+		serviceAccount string
+	}{
+		// the users of the hub of --hub-kubeconfig keep their identity, but its serviceaccounts
+		"hub":   {user: "alice", groups: []string{"admins"}, serviceAccount: "cluster:hub:system:serviceaccount:default:app"},
+		"hub-b": {user: "cluster:hub-b:alice", groups: []string{"cluster:hub-b:admins"}, serviceAccount: "cluster:hub-b:system:serviceaccount:default:app"},
+		"hub-c": {user: "cluster:hub-c:alice", groups: []string{"cluster:hub-c:admins"}, serviceAccount: "cluster:hub-c:system:serviceaccount:default:app"},
+	}
+
+	usernames := map[string]bool{}
+	for _, hub := range hubs {
+		expect := expects[hub.name]
+		if actual := hub.username(user); actual != expect.user {
+			t.Errorf("hub %s: expected user %q, got %q", hub.name, expect.user, actual)
+		}
+		if actual := hub.groups(user); !reflect.DeepEqual(actual, expect.groups) {
+			t.Errorf("hub %s: expected groups %v, got %v", hub.name, expect.groups, actual)
+		}
+		if actual := hub.username(serviceAccount); actual != expect.serviceAccount {
+			t.Errorf("hub %s: expected serviceaccount %q, got %q", hub.name, expect.serviceAccount, actual)
+		}
+		usernames[hub.username(user)] = true
+	}
+	// the same user of each hub is a distinct user of the managed cluster
+	if len(usernames) != len(hubs) {
+		t.Errorf("expected distinct usernames for the %d hubs, got %v", len(hubs), usernames)
+	}
+}
+
+// testJWT returns an unsigned JWT token of the issuer.
+func testJWT(issuer string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"` + issuer + `","sub":"system:serviceaccount:default:app"}`))
+	return "eyJhbGciOiJSUzI1NiJ9." + payload + ".c2lnbmF0dXJl"
+}
+
+func TestHubsForToken(t *testing.T) {
+	hubA := &trustedHub{name: "hub-a", issuer: "https://hub-a.example.com"}
+	hubB := &trustedHub{name: "hub-b", issuer: "https://hub-b.example.com"}
+	hubC := &trustedHub{name: "hub-c"}
+	s := &serviceProxy{hubs: []*trustedHub{hubA, hubB, hubC}}
+
+	testcases := []struct {
+		name   string
+		token  string
+		expect []string
+	}{
+		{name: "issuer of a hub", token: testJWT("https://hub-b.example.com"), expect: []string{"hub-b"}},
+		{name: "unknown issuer", token: testJWT("https://other.example.com"), expect: []string{"hub-c"}},
+		{name: "opaque token", token: "sha256~abcdef", expect: []string{"hub-a", "hub-b", "hub-c"}},
+		{name: "invalid payload", token: "a.!!.c", expect: []string{"hub-a", "hub-b", "hub-c"}},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.name, func(t *testing.T) {
+			names := []string{}
+			for _, hub := range s.hubsForToken(c.token) {
+				names = append(names, hub.name)
+			}
+			if !reflect.DeepEqual(names, c.expect) {
+				t.Errorf("expected %v, got %v", c.expect, names)
+			}
+		})
+	}
+}
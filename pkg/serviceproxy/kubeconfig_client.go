@@ -0,0 +1,184 @@
+package serviceproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/stolostron/cluster-proxy-addon/pkg/utils"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+)
+
+// kubeconfigClient holds the kube client built from a kubeconfig, e.g. the one of a hub cluster. It is
+// rebuilt when the kubeconfig or the files it references change, e.g. when the addon agent rotates the hub
+// client certificate, and swapped once the new credentials are verified, so the requests in flight keep
+// using the previous client.
+type kubeconfigClient struct {
+	// name identifies the kubeconfig in the logs
+	name       string
+	kubeconfig string
+	// verify checks the credentials of a reloaded client
+	verify func(kubernetes.Interface) error
+
+	lock    sync.Mutex
+	content []byte
+	files   []string
+	state   atomic.Pointer[kubeconfigState]
+	err     atomic.Pointer[error]
+}
+
+// kubeconfigState is the client and the rest config built from the same kubeconfig.
+type kubeconfigState struct {
+	config *rest.Config
+	client kubernetes.Interface
+}
+
+func newKubeconfigClient(name, kubeconfig string) (*kubeconfigClient, error) {
+	h := &kubeconfigClient{name: name, kubeconfig: kubeconfig, verify: verifyCredentials}
+	// the cluster is not required to be reachable to start, and invalid credentials are reported by the
+	// health probes
+	if err := h.reload(); err != nil && h.state.Load() == nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// verifyCredentials returns an error if the client is not authenticated by the kube-apiserver. A
+// SelfSubjectReview is allowed to every authenticated user, so it is forbidden when the credentials are
+// not presented or are ignored and the request is anonymous, e.g. an expired client certificate. The other
+// errors, e.g. when the hub is unreachable, tell nothing about the credentials.
+func verifyCredentials(client kubernetes.Interface) error {
+	review, err := client.AuthenticationV1().SelfSubjectReviews().Create(context.TODO(), &authenticationv1.SelfSubjectReview{}, metav1.CreateOptions{})
+	switch {
+	case apierrors.IsUnauthorized(err), apierrors.IsForbidden(err):
+		return err
+	case err != nil:
+		klog.Warningf("failed to verify the credentials of a kubeconfig: %v", err)
+	case review.Status.UserInfo.Username == user.Anonymous:
+		return fmt.Errorf("the requests are authenticated as %s", user.Anonymous)
+	}
+	return nil
+}
+
+// get returns the client built from the last valid kubeconfig.
+func (h *kubeconfigClient) get() kubernetes.Interface {
+	return h.state.Load().client
+}
+
+// restConfig returns the rest config of the last valid kubeconfig, it must not be modified.
+func (h *kubeconfigClient) restConfig() *rest.Config {
+	return h.state.Load().config
+}
+
+// reload rebuilds the client if the kubeconfig or the files it references changed.
+func (h *kubeconfigClient) reload() error {
+	config, err := clientcmd.LoadFromFile(h.kubeconfig)
+	if err != nil {
+		return err
+	}
+	if err := clientcmd.ResolveLocalPaths(config); err != nil {
+		return err
+	}
+
+	files := []string{h.kubeconfig}
+	for _, authInfo := range config.AuthInfos {
+		files = append(files, nonEmpty(clientcmd.GetAuthInfoFileReferences(authInfo))...)
+	}
+	for _, cluster := range config.Clusters {
+		files = append(files, nonEmpty(clientcmd.GetClusterFileReferences(cluster))...)
+	}
+	sort.Strings(files[1:])
+
+	var content []byte
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		content = append(content, data...)
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	// the referenced files are watched whether the content is valid or not
+	h.files = files
+	if bytes.Equal(content, h.content) {
+		// e.g. the invalid credentials are rolled back to the ones of the client in use
+		h.err.Store(nil)
+		kubeconfigCredentialsValid.WithLabelValues(h.name).Set(1)
+		return nil
+	}
+
+	restConfig, err := clientcmd.NewDefaultClientConfig(*config, &clientcmd.ConfigOverrides{}).ClientConfig()
+	if err != nil {
+		return err
+	}
+	client, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return err
+	}
+	if h.verify != nil {
+		if err := h.verify(client); err != nil {
+			err = fmt.Errorf("the credentials of the %s kubeconfig %s are invalid: %v", h.name, h.kubeconfig, err)
+			h.err.Store(&err)
+			kubeconfigCredentialsValid.WithLabelValues(h.name).Set(0)
+			if h.state.Load() == nil {
+				// the first kubeconfig is used until valid credentials are loaded, the content is not
+				// recorded so that it is verified again on the next change
+				h.state.Store(&kubeconfigState{config: restConfig, client: client})
+			}
+			// the previous client is kept, the health checks fail until valid credentials are loaded
+			return err
+		}
+	}
+
+	h.content = content
+	h.state.Store(&kubeconfigState{config: restConfig, client: client})
+	h.err.Store(nil)
+	kubeconfigCredentialsValid.WithLabelValues(h.name).Set(1)
+	klog.Infof("loaded the %s kubeconfig %s", h.name, h.kubeconfig)
+	return nil
+}
+
+// check is a health check failing if the credentials of the last kubeconfig loaded are invalid.
+func (h *kubeconfigClient) check(_ *http.Request) error {
+	if err := h.err.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// run reloads the client when the files change until the context is done. The files are resolved again on
+// each reload, as the kubeconfig may reference other files once it is rotated.
+func (h *kubeconfigClient) run(ctx context.Context) {
+	utils.WatchFileSet(ctx, h.name+"-kubeconfig", h.watchedFiles, h.reload)
+}
+
+// watchedFiles returns the kubeconfig and the files referenced by its last content.
+func (h *kubeconfigClient) watchedFiles() []string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.files
+}
+
+func nonEmpty(refs []*string) []string {
+	files := []string{}
+	for _, ref := range refs {
+		if ref != nil && *ref != "" {
+			files = append(files, *ref)
+		}
+	}
+	return files
+}
@@ -0,0 +1,176 @@
+package serviceproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// newTestReviewServer returns a kube-apiserver reviewing the requests with the token as hub, rejecting the
+// requests with another token with 401, and forbidding the anonymous ones. It serves TLS, as the credentials
+// are not sent otherwise.
+func newTestReviewServer(t *testing.T, token string) *httptest.Server {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Header.Get("Authorization") {
+		case "Bearer " + token:
+			_ = json.NewEncoder(w).Encode(&authenticationv1.SelfSubjectReview{
+				Status: authenticationv1.SelfSubjectReviewStatus{UserInfo: authenticationv1.UserInfo{Username: "hub"}},
+			})
+		case "":
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(&metav1.Status{Status: metav1.StatusFailure, Reason: metav1.StatusReasonForbidden, Code: http.StatusForbidden})
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(&metav1.Status{Status: metav1.StatusFailure, Reason: metav1.StatusReasonUnauthorized, Code: http.StatusUnauthorized})
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func writeTestKubeconfig(t *testing.T, path, server, token string) {
+	kubeconfig := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: cluster
+  cluster:
+    server: %s
+    insecure-skip-tls-verify: true
+users:
+- name: user
+  user:
+    token: %s
+contexts:
+- name: default
+  context:
+    cluster: cluster
+    user: user
+current-context: default
+`, server, token)
+	if err := os.WriteFile(path, []byte(kubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKubeconfigClient(t *testing.T) {
+	server := newTestReviewServer(t, "valid")
+	unreachable := httptest.NewTLSServer(http.NotFoundHandler())
+	unreachable.Close()
+
+	testcases := []struct {
+		name         string
+		server       string
+		tokens       []string
+		expectErrors []bool
+		expectTokens []string
+	}{
+		{
+			name:         "valid credentials",
+			server:       server.URL,
+			tokens:       []string{"valid"},
+			expectErrors: []bool{false},
+			expectTokens: []string{"valid"},
+		},
+		{
+			name:         "invalid credentials on the first load",
+			server:       server.URL,
+			tokens:       []string{"invalid", "valid"},
+			expectErrors: []bool{true, false},
+			expectTokens: []string{"invalid", "valid"},
+		},
+		{
+			name:         "invalid credentials reloaded",
+			server:       server.URL,
+			tokens:       []string{"valid", "invalid", "valid"},
+			expectErrors: []bool{false, true, false},
+			expectTokens: []string{"valid", "valid", "valid"},
+		},
+		{
+			name:         "anonymous",
+			server:       server.URL,
+			tokens:       []string{"valid", "", "valid"},
+			expectErrors: []bool{false, true, false},
+			expectTokens: []string{"valid", "valid", "valid"},
+		},
+		{
+			name:         "unreachable cluster",
+			server:       unreachable.URL,
+			tokens:       []string{"invalid"},
+			expectErrors: []bool{false},
+			expectTokens: []string{"invalid"},
+		},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.name, func(t *testing.T) {
+			kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+			var client *kubeconfigClient
+			for i, token := range c.tokens {
+				writeTestKubeconfig(t, kubeconfig, c.server, token)
+				if i == 0 {
+					var err error
+					if client, err = newKubeconfigClient("test", kubeconfig); err != nil {
+						t.Fatalf("expected no error, got %v", err)
+					}
+				} else {
+					_ = client.reload()
+				}
+
+				if err := client.check(nil); (err != nil) != c.expectErrors[i] {
+					t.Errorf("load %d: expected check error %v, got %v", i, c.expectErrors[i], err)
+				}
+				if actual := client.restConfig().BearerToken; actual != c.expectTokens[i] {
+					t.Errorf("load %d: expected the client of token %q, got %q", i, c.expectTokens[i], actual)
+				}
+			}
+		})
+	}
+}
+
+func TestKubeconfigClientWatchedFiles(t *testing.T) {
+	server := newTestReviewServer(t, "valid")
+	dir := t.TempDir()
+	kubeconfig := filepath.Join(dir, "kubeconfig")
+	writeTestKubeconfig(t, kubeconfig, server.URL, "valid")
+	client, err := newKubeconfigClient("test", kubeconfig)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if actual := client.watchedFiles(); !slices.Equal(actual, []string{kubeconfig}) {
+		t.Errorf("expected %v, got %v", []string{kubeconfig}, actual)
+	}
+
+	// the rotated kubeconfig references a token file, even though its credentials are rejected
+	tokenFile := filepath.Join(dir, "token", "token")
+	if err := os.MkdirAll(filepath.Dir(tokenFile), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tokenFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeTestKubeconfig(t, kubeconfig, server.URL, "")
+	content, err := os.ReadFile(kubeconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content = []byte(strings.Replace(string(content), "    token: \n", "    tokenFile: "+tokenFile+"\n", 1))
+	if err := os.WriteFile(kubeconfig, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.reload(); err == nil {
+		t.Errorf("expected the credentials to be rejected")
+	}
+	if expect, actual := []string{kubeconfig, tokenFile}, client.watchedFiles(); !slices.Equal(actual, expect) {
+		t.Errorf("expected %v, got %v", expect, actual)
+	}
+}
@@ -0,0 +1,135 @@
+package serviceproxy
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/stolostron/cluster-proxy-addon/pkg/utils"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const (
+	metricsNamespace = "open_cluster_management_cluster_proxy_addon"
+	metricsSubsystem = "service_proxy"
+)
+
+// target label values.
+const (
+	targetAPIServer = "apiserver"
+	targetService   = "service"
+)
+
+// authentication result label values.
+const (
+	authResultManagedToken = "managed_token"
+	authResultHubToken     = "hub_token"
+	authResultRejected     = "rejected"
+	authResultError        = "error"
+)
+
+// tokenreview cluster label values.
+const (
+	tokenReviewClusterManaged = "managed"
+	tokenReviewClusterHub     = "hub"
+)
+
+// tokenReviewInCluster is the name label value of the TokenReviews sent to the managed cluster with the in-cluster config.
+const tokenReviewInCluster = "in-cluster"
+
+var (
+	requestsTotal = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "requests_total",
+			Help:      "Number of requests handled by the service-proxy, labeled by target (apiserver or service) and HTTP response code.",
+		},
+		[]string{"target", "code"},
+	)
+
+	authenticationsTotal = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "authentications_total",
+			Help:      "Number of authentications of kube-apiserver requests, labeled by result (managed_token, hub_token, rejected or error).",
+		},
+		[]string{"result"},
+	)
+
+	tokenReviewDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "tokenreview_duration_seconds",
+			Help: "Latency of TokenReview requests, labeled by the cluster (managed or hub) the review is sent to, its name (the name of the hub, " +
+				"or of the apiserver kubeconfig of the managed cluster, in-cluster otherwise) and whether it errored.",
+			Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		},
+		[]string{"cluster", "name", "error"},
+	)
+
+	hubAuthenticationsTotal = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "hub_authentications_total",
+			Help:      "Number of hub users authenticated, labeled by the hub which authenticated them.",
+		},
+		[]string{"hub"},
+	)
+
+	impersonationsTotal = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "impersonations_total",
+			Help:      "Number of requests forwarded to the kube-apiserver on behalf of a hub user, labeled by whether the hub user is a serviceaccount.",
+		},
+		[]string{"serviceaccount"},
+	)
+
+	kubeconfigCredentialsValid = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "kubeconfig_credentials_valid",
+			Help:      "Whether the credentials of the last kubeconfig loaded are accepted by the cluster, labeled by the name of the kubeconfig, e.g. hub-hub.",
+		},
+		[]string{"kubeconfig"},
+	)
+
+	upstreamErrorsTotal = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "upstream_errors_total",
+			Help:      "Number of failures to proxy requests to the target, labeled by target (apiserver or service).",
+		},
+		[]string{"target"},
+	)
+)
+
+func init() {
+	legacyregistry.MustRegister(
+		requestsTotal,
+		authenticationsTotal,
+		tokenReviewDuration,
+		hubAuthenticationsTotal,
+		impersonationsTotal,
+		upstreamErrorsTotal,
+		kubeconfigCredentialsValid,
+	)
+}
+
+// recordRequest records the metrics of a finished request.
+func recordRequest(target string, rw *utils.ResponseRecorder) {
+	requestsTotal.WithLabelValues(target, strconv.Itoa(rw.StatusCode())).Inc()
+}
+
+// recordTokenReview records the latency of a TokenReview sent to the given cluster, the name is one of the
+// configured hubs or kubeconfigs, so the series are bounded.
+func recordTokenReview(cluster, name string, start time.Time, err error) {
+	tokenReviewDuration.WithLabelValues(cluster, name, strconv.FormatBool(err != nil)).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,71 @@
+package serviceproxy
+
+import (
+	"context"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+// tokenReviewCount returns the number of TokenReviews recorded with the labels.
+func tokenReviewCount(t *testing.T, labels map[string]string) uint64 {
+	families, err := legacyregistry.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != metricsNamespace+"_"+metricsSubsystem+"_tokenreview_duration_seconds" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			matched := 0
+			for _, label := range metric.GetLabel() {
+				if value, ok := labels[label.GetName()]; ok && value == label.GetValue() {
+					matched++
+				}
+			}
+			if matched == len(labels) {
+				return metric.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
+
+func TestRecordTokenReview(t *testing.T) {
+	users := map[string]authenticationv1.UserInfo{"alice": {Username: "alice"}}
+	hubClient := &kubeconfigClient{}
+	hubClient.state.Store(&kubeconfigState{client: newTestReviewClient(t, users)})
+	backendClient := &kubeconfigClient{name: "apiserver-cluster1"}
+	backendClient.state.Store(&kubeconfigState{client: newTestReviewClient(t, users)})
+	s := &serviceProxy{managedClusterKubeClient: newTestReviewClient(t, users)}
+	hub := &trustedHub{name: "hub-b", enabled: true, client: hubClient}
+
+	testcases := []map[string]string{
+		{"cluster": tokenReviewClusterHub, "name": "hub-b", "error": "false"},
+		{"cluster": tokenReviewClusterManaged, "name": tokenReviewInCluster, "error": "false"},
+		{"cluster": tokenReviewClusterManaged, "name": "apiserver-cluster1", "error": "false"},
+	}
+	// the registry is shared with the other tests
+	before := make([]uint64, len(testcases))
+	for i, labels := range testcases {
+		before[i] = tokenReviewCount(t, labels)
+	}
+
+	if _, _, err := s.hubUserAuthenticatedAndInfo(context.Background(), hub, "alice"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, _, err := s.managedClusterUserAuthenticatedAndInfo(context.Background(), nil, "alice"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, _, err := s.managedClusterUserAuthenticatedAndInfo(context.Background(), &externalAPIServer{client: backendClient}, "alice"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for i, labels := range testcases {
+		if actual := tokenReviewCount(t, labels) - before[i]; actual != 1 {
+			t.Errorf("expected 1 TokenReview recorded with %v, got %d", labels, actual)
+		}
+	}
+}
@@ -3,28 +3,41 @@ package serviceproxy
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/stolostron/cluster-proxy-addon/pkg/constant"
+	"github.com/stolostron/cluster-proxy-addon/pkg/tracing"
 	"github.com/stolostron/cluster-proxy-addon/pkg/utils"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	authenticationv1 "k8s.io/api/authentication/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
-	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
-	addonutils "open-cluster-management.io/addon-framework/pkg/utils"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
 )
 
+const (
+	// requestIDExtraKey is the impersonation extra key the request id is forwarded to the kube-apiserver with.
+	requestIDExtraKey = "cluster-proxy.open-cluster-management.io/request-id"
+)
+
+// requestIDExtraHeader is the impersonation header of requestIDExtraKey, the key is percent-encoded as required by the kube-apiserver.
+var requestIDExtraHeader = authenticationv1.ImpersonateUserExtraHeaderPrefix + url.PathEscape(requestIDExtraKey)
+
 func NewServiceProxyCommand() *cobra.Command {
 	serviceProxyServer := newServiceProxy()
 
@@ -33,7 +46,7 @@ func NewServiceProxyCommand() *cobra.Command {
 		Short: "service-proxy",
 		Long:  `A http proxy server, receives http requests from proxy-agent and forwards to the target service.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return serviceProxyServer.Run(cmd.Context())
+			return serviceProxyServer.Run(signals.SetupSignalHandler())
 		},
 	}
 
@@ -44,7 +57,8 @@ func NewServiceProxyCommand() *cobra.Command {
 type serviceProxy struct {
 	cert, key    string
 	ocpserviceCA string
-	rootCAs      *x509.CertPool
+	rootCAs      *utils.CAReloader
+	servingCert  *utils.CertificateReloader
 
 	maxIdleConns          int
 	idleConnTimeout       time.Duration
@@ -52,12 +66,40 @@ type serviceProxy struct {
 	expectContinueTimeout time.Duration
 
 	hubKubeConfig            string
-	hubKubeClient            kubernetes.Interface
+	hubName                  string
+	hubIdentityPrefix        string
+	hubIssuer                string
+	additionalHubs           []string
+	hubs                     []*trustedHub
+	impersonateRequestID     bool
 	managedClusterKubeClient kubernetes.Interface
+
+	apiServerKubeConfig string
+	externalAPIServer   *externalAPIServer
+	clusterName         string
+	// apiServerBackendValues are the values of --apiserver
+	apiServerBackendValues     []string
+	apiServerBackendsByCluster map[string]*externalAPIServer
+
+	// forwardedUserHeader is the header of the authenticated user on the requests to the services
+	forwardedUserHeader string
+
+	serviceTLSOptions *serviceTLSOptions
+	serviceTLSConfigs *serviceTLSConfigs
+
+	tracingOptions *tracing.Options
+
+	shutdownOptions *utils.ShutdownOptions
+	drainer         *utils.Drainer
 }
 
 func newServiceProxy() *serviceProxy {
-	return &serviceProxy{}
+	return &serviceProxy{
+		tracingOptions:    tracing.NewOptions(),
+		shutdownOptions:   utils.NewShutdownOptions(),
+		drainer:           utils.NewDrainer(),
+		serviceTLSOptions: newServiceTLSOptions(),
+	}
 }
 
 func (s *serviceProxy) AddFlags(cmd *cobra.Command) {
@@ -69,12 +111,32 @@ func (s *serviceProxy) AddFlags(cmd *cobra.Command) {
 
 	// hubKubeConfig is the kubeconfig file for connecting to the hub cluster
 	flags.StringVar(&s.hubKubeConfig, "hub-kubeconfig", "", "The kubeconfig file for connecting to the hub cluster")
+	flags.StringVar(&s.hubName, "hub-name", "hub", "The name of the hub of --hub-kubeconfig, it identifies the hub in the logs and the metrics")
+	flags.StringVar(&s.hubIdentityPrefix, "hub-identity-prefix", defaultIdentityPrefix("hub"), "The prefix of the username of the serviceaccounts of the hub of --hub-kubeconfig when they are impersonated")
+	flags.StringVar(&s.hubIssuer, "hub-issuer", s.hubIssuer, "The issuer of the serviceaccount tokens of the hub of --hub-kubeconfig. If set, the JWT tokens of other issuers are not sent to this hub to be reviewed")
+	flags.StringArrayVar(&s.additionalHubs, "hub", s.additionalHubs, "An additional hub whose users are authenticated, after the hub of --hub-kubeconfig, as comma-separated key=value pairs: "+
+		"name, kubeconfig, identity-prefix (default cluster:<name>:), identity-prefix-scope, serviceaccounts or all (default) to prefix the username of all the users and their groups, "+
+		"issuer, the issuer of its JWT tokens which are only sent to this hub, and enabled (default true), e.g. name=hub-b,kubeconfig=/var/run/hub-b/kubeconfig. It can be repeated")
+	flags.BoolVar(&s.impersonateRequestID, "impersonate-request-id", false, "Forward the request id to the kube-apiserver as an impersonation extra of hub users, so it shows up in the audit logs. "+
+		"Requires the impersonate permission on userextras/"+requestIDExtraKey)
+	flags.StringVar(&s.apiServerKubeConfig, "apiserver-kubeconfig", s.apiServerKubeConfig, "The kubeconfig of the kube-apiserver of the managed cluster, if the service-proxy does not run on the managed cluster, "+
+		"e.g. when its control plane is hosted. The requests to the kube-apiserver are proxied to its server, and its credentials, a token or a client certificate, are used to review the tokens and to impersonate the hub users")
+	flags.StringVar(&s.clusterName, "cluster-name", s.clusterName, "The name of the managed cluster of the default kube-apiserver, the one of --apiserver-kubeconfig or of the in-cluster config. "+
+		"It is required to reach the default kube-apiserver once --apiserver is set")
+	flags.StringArrayVar(&s.apiServerBackendValues, "apiserver", s.apiServerBackendValues, "The kube-apiserver of another managed cluster served by the service-proxy, e.g. a hosted control plane, as comma-separated key=value pairs: "+
+		"cluster and kubeconfig, e.g. cluster=hosted-1,kubeconfig=/var/run/hosted-1/kubeconfig. The requests to the kube-apiserver of the cluster are proxied and authenticated as for --apiserver-kubeconfig. It can be repeated")
+	flags.StringVar(&s.forwardedUserHeader, "forwarded-user-header", s.forwardedUserHeader, "The header, e.g. X-Forwarded-User, set to the username of the caller on the requests to the services, "+
+		"once its token is authenticated by the managed cluster or a hub, for the apps which trust the proxy to authenticate their users. The header sent by the caller is always removed")
 
 	// proxy related flags
 	flags.IntVar(&s.maxIdleConns, "max-idle-conns", 100, "The maximum number of idle (keep-alive) connections across all hosts.")
 	flags.DurationVar(&s.idleConnTimeout, "idle-conn-timeout", 90*time.Second, "The maximum amount of time an idle (keep-alive) connection will remain idle before closing itself.")
 	flags.DurationVar(&s.tLSHandshakeTimeout, "tls-handshake-timeout", 10*time.Second, "The maximum amount of time waiting to wait for a TLS handshake.")
 	flags.DurationVar(&s.expectContinueTimeout, "expect-continue-timeout", 1*time.Second, "The amount of time to wait for a server's first response headers after fully writing the request headers if the request has an \"Expect: 100-continue\" header.")
+
+	s.serviceTLSOptions.addFlags(cmd)
+	s.tracingOptions.AddFlags(cmd)
+	s.shutdownOptions.AddFlags(cmd)
 }
 
 func (s *serviceProxy) Run(ctx context.Context) error {
@@ -82,70 +144,98 @@ func (s *serviceProxy) Run(ctx context.Context) error {
 		rootCAFile = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
 	)
 	var err error
-	customChecks := []healthz.Checker{}
 
-	cc, err := addonutils.NewConfigChecker("cert", s.cert, s.key, rootCAFile)
-	if err != nil {
+	if err := s.validate(); err != nil {
 		return err
 	}
-	customChecks = append(customChecks, cc.Check)
+	// ctx only triggers the shutdown, the certificates and the clients are still reloaded while the requests are drained
+	runCtx := s.drainer.Context()
 
-	if err := s.validate(); err != nil {
+	// the certificates are reloaded when they are rotated, and used by the new connections
+	if s.servingCert, err = utils.NewCertificateReloader("service-proxy-serving", s.cert, s.key); err != nil {
 		return err
 	}
+	go s.servingCert.Run(runCtx)
 
-	// get root CAs
-	s.rootCAs = x509.NewCertPool()
-	// ca for accessing apiserver
-
-	apiserverPem, err := os.ReadFile(rootCAFile)
-	if err != nil {
+	// get root CAs, the ca for accessing apiserver and the ca for accessing ocp services
+	rootCAFiles := []string{rootCAFile}
+	if _, err := os.Stat(s.ocpserviceCA); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		klog.Infof("ocpservice-ca is not provided")
+	} else {
+		rootCAFiles = append(rootCAFiles, s.ocpserviceCA)
+	}
+	if s.rootCAs, err = utils.NewCAReloader("service-proxy-root-ca", rootCAFiles...); err != nil {
 		return err
 	}
-	s.rootCAs.AppendCertsFromPEM(apiserverPem)
-	// ca for accessing ocp services
-	ocpserviceCAPem, err := os.ReadFile(s.ocpserviceCA)
-	if err != nil {
-		if os.IsNotExist(err) {
-			klog.Infof("ocpservice-ca is not provided")
-		} else {
-			return err
+	go s.rootCAs.Run(runCtx)
+
+	if s.apiServerKubeConfig != "" {
+		// the kube-apiserver of the managed cluster is reached with the apiserver kubeconfig, which is reloaded when it is rotated
+		if s.externalAPIServer, err = newExternalAPIServer("apiserver", s.apiServerKubeConfig); err != nil {
+			return fmt.Errorf("failed to load the apiserver kubeconfig: %v", err)
 		}
 	} else {
-		s.rootCAs.AppendCertsFromPEM(ocpserviceCAPem)
+		// init managedClusterKubeClient
+		// managedClusterKubeClient is the kubeClient of current cluster using in-cluster config
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			return fmt.Errorf("failed to get in-cluster config: %v", err)
+		}
 
-		// add configchecker into http probes only when ocpservice-ca is provided
-		cc, err := addonutils.NewConfigChecker("ocpservice-ca", s.ocpserviceCA)
+		s.managedClusterKubeClient, err = kubernetes.NewForConfig(config)
 		if err != nil {
 			return err
 		}
-		customChecks = append(customChecks, cc.Check)
 	}
-
-	// init managedClusterKubeClient
-	// managedClusterKubeClient is the kubeClient of current cluster using in-cluster config
-	config, err := rest.InClusterConfig()
-	if err != nil {
-		return fmt.Errorf("failed to get in-cluster config: %v", err)
+	var serviceClient kubernetes.Interface
+	if s.serviceTLSOptions.annotations || s.serviceTLSOptions.clientCertificates {
+		// the services are the ones of the cluster the service-proxy runs on, even if the control plane of the managed cluster is hosted
+		if serviceClient = s.managedClusterKubeClient; serviceClient == nil {
+			config, err := rest.InClusterConfig()
+			if err != nil {
+				return fmt.Errorf("failed to get in-cluster config: %v", err)
+			}
+			if serviceClient, err = kubernetes.NewForConfig(config); err != nil {
+				return err
+			}
+		}
 	}
+	s.serviceTLSConfigs = newServiceTLSConfigs(s.serviceTLSOptions, serviceClient)
 
-	s.managedClusterKubeClient, err = kubernetes.NewForConfig(config)
-	if err != nil {
+	if s.apiServerBackendsByCluster, err = s.apiServerBackends(); err != nil {
 		return err
 	}
+	s.runAPIServers(runCtx)
 
-	// get hubKubeConfig
-	hubConfig, err := clientcmd.BuildConfigFromFlags("", s.hubKubeConfig)
-	if err != nil {
+	// get the kubeconfig of each hub, the hub clients are rebuilt when the hub kubeconfigs are rotated
+	if s.hubs, err = s.trustedHubs(); err != nil {
 		return err
 	}
-	s.hubKubeClient, err = kubernetes.NewForConfig(hubConfig)
+	for _, hub := range s.hubs {
+		if hub.client, err = newKubeconfigClient("hub-"+hub.name, hub.kubeconfig); err != nil {
+			return fmt.Errorf("failed to load the kubeconfig of hub %s: %v", hub.name, err)
+		}
+	}
+	s.runHubs(runCtx)
+
+	shutdownTracing, err := tracing.Init(ctx, "cluster-proxy-service-proxy", s.tracingOptions)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			klog.Errorf("failed to shutdown tracing: %v", err)
+		}
+	}()
 
 	go func() {
-		if err = utils.ServeHealthProbes(":8000", customChecks...); err != nil {
+		// the Deployment of the service-proxy only probes the liveness, invalid kubeconfig credentials fail both
+		// probes so that they are reported, the kubeconfigs are still reloaded in place once they are rotated
+		credentialChecks := []healthz.Checker{s.checkHubs, s.checkAPIServers}
+		if err = utils.ServeProbes(":8000", credentialChecks, append(credentialChecks, s.drainer.Ready)); err != nil {
 			klog.Fatal(err)
 		}
 	}()
@@ -153,19 +243,23 @@ func (s *serviceProxy) Run(ctx context.Context) error {
 	httpserver := &http.Server{
 		Addr: fmt.Sprintf(":%d", constant.ServiceProxyPort),
 		TLSConfig: &tls.Config{
-			MinVersion: tls.VersionTLS12,
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: s.servingCert.GetCertificate,
 		},
-		Handler: s,
+		Handler: otelhttp.NewHandler(s, "service-proxy"),
 	}
 
-	return httpserver.ListenAndServeTLS(s.cert, s.key)
+	return utils.RunServer(ctx, httpserver, s.shutdownOptions, s.drainer)
 }
 
 func (s *serviceProxy) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	// the request id is normally set by the user-server, and is forwarded to the target
+	requestID := utils.EnsureRequestID(wr, req)
+
 	if klog.V(4).Enabled() {
 		dump, err := httputil.DumpRequest(req, true)
 		if err != nil {
-			http.Error(wr, err.Error(), http.StatusBadRequest)
+			utils.HTTPError(wr, req, err.Error(), http.StatusBadRequest)
 			return
 		}
 		klog.V(4).Infof("request:\n %s", string(dump))
@@ -173,21 +267,96 @@ func (s *serviceProxy) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 
 	url, err := utils.GetTargetServiceURLFromRequest(req)
 	if err != nil {
-		http.Error(wr, err.Error(), http.StatusBadRequest)
-		klog.Errorf("failed to get target service url from request: %v", err)
+		utils.HTTPError(wr, req, err.Error(), http.StatusBadRequest)
+		klog.Errorf("failed to get target service url from request: %v, request id: %s", err, requestID)
 		return
 	}
 
-	if url.Host == "kubernetes.default.svc" {
-		if err := s.processAuthentication(req); err != nil {
-			klog.ErrorS(err, "authentication failed")
-			http.Error(wr, err.Error(), http.StatusUnauthorized)
+	target := targetService
+	if url.Host == inClusterAPIServerHost {
+		target = targetAPIServer
+	}
+
+	rw := utils.NewResponseRecorder(wr)
+	defer func(start time.Time) {
+		recordRequest(target, rw)
+		klog.V(2).InfoS("request handled", "requestID", requestID, "target", url.Host,
+			"method", req.Method, "path", req.URL.Path, "code", rw.StatusCode(), "duration", time.Since(start))
+	}(time.Now())
+
+	trace.SpanFromContext(req.Context()).SetAttributes(
+		attribute.String("target", url.Host),
+		attribute.String("request_id", requestID),
+	)
+
+	// the timings are only reported back to the client, the target does not need to know about them
+	timing := utils.NewServerTimingFromRequest(req, "service-proxy")
+	req.Header.Del(utils.HeaderServerTimingRequest)
+
+	var tlsConfig *tls.Config
+	if target == targetAPIServer {
+		cluster := utils.GetTargetClusterFromRequest(req)
+		backend, err := s.apiServerFor(cluster)
+		if err != nil {
+			klog.ErrorS(err, "failed to get the kube-apiserver", "requestID", requestID)
+			timing.WriteHeader(rw.Header())
+			utils.HTTPError(rw, req, err.Error(), http.StatusNotFound)
+			return
+		}
+		if backend != nil {
+			trace.SpanFromContext(req.Context()).SetAttributes(attribute.String("cluster", cluster))
+		}
+
+		authStart := time.Now()
+		impersonated, err := s.processAuthentication(req, backend)
+		timing.Since("auth", "authenticate and impersonate", authStart)
+		if err != nil {
+			klog.ErrorS(err, "authentication failed", "requestID", requestID)
+			timing.WriteHeader(rw.Header())
+			utils.HTTPError(rw, req, err.Error(), http.StatusUnauthorized)
 			return
 		}
+
+		if url, tlsConfig, err = s.apiServerTarget(backend, url, impersonated); err != nil {
+			klog.ErrorS(err, "failed to get the kube-apiserver", "requestID", requestID)
+			timing.WriteHeader(rw.Header())
+			utils.HTTPError(rw, req, err.Error(), http.StatusBadGateway)
+			return
+		}
+	} else {
+		if s.forwardedUserHeader != "" {
+			authStart := time.Now()
+			s.setForwardedUser(req)
+			timing.Since("auth", "authenticate the forwarded user", authStart)
+		}
+
+		if url.Scheme == "https" {
+			namespace, service := req.Header.Get("Cluster-Proxy-Namespace"), req.Header.Get("Cluster-Proxy-Service")
+			if tlsConfig, err = s.serviceTLSConfigs.tlsConfig(req.Context(), namespace, service, s.rootCAs.Pool()); err != nil {
+				klog.ErrorS(err, "failed to get the TLS configuration of the service", "requestID", requestID)
+				timing.WriteHeader(rw.Header())
+				// the details name the objects of the cluster, they are only logged
+				utils.HTTPError(rw, req, fmt.Sprintf("failed to get the TLS configuration of the service %s/%s", namespace, service), http.StatusBadGateway)
+				return
+			}
+			if tlsConfig.GetClientCertificate != nil {
+				authStart := time.Now()
+				code, err := s.authorizeClientCertificate(req, namespace, service)
+				timing.Since("authz", "authorize the client certificate", authStart)
+				if err != nil {
+					klog.ErrorS(err, "rejected the request to the service with a client certificate", "requestID", requestID)
+					timing.WriteHeader(rw.Header())
+					utils.HTTPError(rw, req, err.Error(), code)
+					return
+				}
+			}
+		}
 	}
+	// the user-server is the previous hop, the X-Forwarded headers it sets are kept
+	utils.SetForwardedHeaders(req, false)
 
 	proxy := httputil.NewSingleHostReverseProxy(url)
-	proxy.Transport = &http.Transport{
+	proxy.Transport = otelhttp.NewTransport(&http.Transport{
 		DialContext: (&net.Dialer{
 			Timeout:   30 * time.Second,
 			KeepAlive: 30 * time.Second,
@@ -196,16 +365,29 @@ func (s *serviceProxy) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
 		IdleConnTimeout:       s.idleConnTimeout,
 		TLSHandshakeTimeout:   s.tLSHandshakeTimeout,
 		ExpectContinueTimeout: s.expectContinueTimeout,
-		TLSClientConfig: &tls.Config{
-			RootCAs:    s.rootCAs,
-			MinVersion: tls.VersionTLS12,
-		},
+		TLSClientConfig:       tlsConfig,
 		// golang http pkg automaticly upgrade http connection to http2 connection, but http2 can not upgrade to SPDY which used in "kubectl exec".
 		// set ForceAttemptHTTP2 = false to prevent auto http2 upgration
 		ForceAttemptHTTP2: false,
+	})
+
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// the request id is already set on the response
+		resp.Header.Del(utils.HeaderRequestID)
+		timing.WriteHeader(resp.Header)
+		s.drainer.WrapResponse(resp)
+		return nil
+	}
+
+	proxy.ErrorHandler = func(rw http.ResponseWriter, r *http.Request, e error) {
+		upstreamErrorsTotal.WithLabelValues(target).Inc()
+		klog.Errorf("proxy to %s failed because %v, request id: %s", url.Host, e, requestID)
+		timing.WriteHeader(rw.Header())
+		rw.WriteHeader(http.StatusBadGateway)
 	}
 
-	proxy.ServeHTTP(wr, req)
+	ctx := tracing.WithTLSHandshakeSpan(req.Context(), "UpstreamTLSHandshake")
+	proxy.ServeHTTP(rw, req.WithContext(timing.WithClientTrace(ctx, url.Host)))
 }
 
 func (s *serviceProxy) validate() error {
@@ -215,15 +397,22 @@ func (s *serviceProxy) validate() error {
 	if s.key == "" {
 		return fmt.Errorf("key is required")
 	}
-	return nil
+	if err := s.serviceTLSOptions.validate(); err != nil {
+		return err
+	}
+	return s.tracingOptions.Validate()
 }
 
-func (s *serviceProxy) hubUserAuthenticatedAndInfo(token string) (bool, *authenticationv1.UserInfo, error) {
-	tokenReview, err := s.hubKubeClient.AuthenticationV1().TokenReviews().Create(context.Background(), &authenticationv1.TokenReview{
+func (s *serviceProxy) hubUserAuthenticatedAndInfo(ctx context.Context, hub *trustedHub, token string) (bool, *authenticationv1.UserInfo, error) {
+	ctx, span := tracing.Start(ctx, "HubTokenReview", trace.WithAttributes(attribute.String("hub", hub.name)))
+	start := time.Now()
+	tokenReview, err := hub.client.get().AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
 		Spec: authenticationv1.TokenReviewSpec{
 			Token: token,
 		},
 	}, metav1.CreateOptions{})
+	recordTokenReview(tokenReviewClusterHub, hub.name, start, err)
+	tracing.End(span, err)
 	if err != nil {
 		return false, nil, err
 	}
@@ -234,12 +423,20 @@ func (s *serviceProxy) hubUserAuthenticatedAndInfo(token string) (bool, *authent
 	return true, &tokenReview.Status.User, nil
 }
 
-func (s *serviceProxy) managedClusterUserAuthenticatedAndInfo(token string) (bool, *authenticationv1.UserInfo, error) {
-	tokenReview, err := s.managedClusterKubeClient.AuthenticationV1().TokenReviews().Create(context.Background(), &authenticationv1.TokenReview{
+func (s *serviceProxy) managedClusterUserAuthenticatedAndInfo(ctx context.Context, backend *externalAPIServer, token string) (bool, *authenticationv1.UserInfo, error) {
+	ctx, span := tracing.Start(ctx, "ManagedClusterTokenReview")
+	start := time.Now()
+	tokenReview, err := s.managedClusterClient(backend).AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
 		Spec: authenticationv1.TokenReviewSpec{
 			Token: token,
 		},
 	}, metav1.CreateOptions{})
+	name := tokenReviewInCluster
+	if backend != nil {
+		name = backend.client.name
+	}
+	recordTokenReview(tokenReviewClusterManaged, name, start, err)
+	tracing.End(span, err)
 	if err != nil {
 		return false, nil, err
 	}
@@ -250,68 +447,112 @@ func (s *serviceProxy) managedClusterUserAuthenticatedAndInfo(token string) (boo
 	return true, &tokenReview.Status.User, nil
 }
 
-func (s *serviceProxy) getImpersonateToken() (string, error) {
-	// Read the latest token from the mounted file
-	token, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/token")
+// processAuthentication handles the authentication flow for both managed cluster and hub users, it returns
+// whether the request impersonates a hub user
+func (s *serviceProxy) processAuthentication(req *http.Request, backend *externalAPIServer) (bool, error) {
+	hub, userInfo, err := s.authenticate(req, backend)
 	if err != nil {
-		return "", err
+		return false, err
 	}
-	return string(token), nil
+
+	if hub != nil {
+		if err := s.processHubUser(req, hub, userInfo, backend); err != nil {
+			authenticationsTotal.WithLabelValues(authResultError).Inc()
+			klog.ErrorS(err, "failed to process hub user")
+			return false, fmt.Errorf("failed to process hub user: %v", err)
+		}
+
+		authenticationsTotal.WithLabelValues(authResultHubToken).Inc()
+		return true, nil
+	}
+
+	authenticationsTotal.WithLabelValues(authResultManagedToken).Inc()
+	return false, nil
 }
 
-// processAuthentication handles the authentication flow for both managed cluster and hub users
-func (s *serviceProxy) processAuthentication(req *http.Request) error {
+// authenticate reviews the token of the request against the managed cluster, then against the hubs. It returns
+// the user and the hub which authenticated it, nil if it is a user of the managed cluster. errNotAuthenticated
+// is returned if neither authenticates it.
+func (s *serviceProxy) authenticate(req *http.Request, backend *externalAPIServer) (*trustedHub, *authenticationv1.UserInfo, error) {
 	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
 
 	// determine if the token is a managed cluster user
-	managedClusterAuthenticated, _, err := s.managedClusterUserAuthenticatedAndInfo(token)
+	managedClusterAuthenticated, managedClusterUserInfo, err := s.managedClusterUserAuthenticatedAndInfo(req.Context(), backend, token)
 	if err != nil {
+		authenticationsTotal.WithLabelValues(authResultError).Inc()
 		klog.ErrorS(err, "managed cluster authentication failed")
-		return fmt.Errorf("managed cluster authentication failed: %v", err)
+		return nil, nil, fmt.Errorf("managed cluster authentication failed: %v", err)
+	}
+	if managedClusterAuthenticated {
+		return nil, managedClusterUserInfo, nil
 	}
 
-	if !managedClusterAuthenticated {
-		// determine if the token is a hub user
-		hubAuthenticated, hubUserInfo, err := s.hubUserAuthenticatedAndInfo(token)
+	// determine if the token is a user of a hub
+	hub, hubUserInfo, err := s.authenticateHubUser(req.Context(), token)
+	if err != nil {
+		authenticationsTotal.WithLabelValues(authResultError).Inc()
+		klog.ErrorS(err, "hub cluster authentication failed")
+		return nil, nil, fmt.Errorf("authentication failed: managed cluster auth: not authenticated, hub cluster auth error: %v", err)
+	}
+	if hub == nil {
+		authenticationsTotal.WithLabelValues(authResultRejected).Inc()
+		klog.ErrorS(errNotAuthenticated, "authentication failed")
+		return nil, nil, errNotAuthenticated
+	}
+	hubAuthenticationsTotal.WithLabelValues(hub.name).Inc()
+	trace.SpanFromContext(req.Context()).SetAttributes(attribute.String("hub", hub.name))
+	klog.V(2).InfoS("authenticated a hub user", "requestID", req.Header.Get(utils.HeaderRequestID), "hub", hub.name, "user", hubUserInfo.Username)
+	return hub, hubUserInfo, nil
+}
+
+// authenticateHubUser reviews the token against the hubs it may be issued by in turn, and returns the first
+// hub which authenticates it, or nil if none does. An error is only returned if no hub authenticates the
+// token and a review failed.
+func (s *serviceProxy) authenticateHubUser(ctx context.Context, token string) (*trustedHub, *authenticationv1.UserInfo, error) {
+	var errs []error
+	for _, hub := range s.hubsForToken(token) {
+		authenticated, userInfo, err := s.hubUserAuthenticatedAndInfo(ctx, hub, token)
 		if err != nil {
-			klog.ErrorS(err, "hub cluster authentication failed")
-			return fmt.Errorf("authentication failed: managed cluster auth: not authenticated, hub cluster auth error: %v", err)
-		}
-		if !hubAuthenticated {
-			klog.ErrorS(err, "authentication failed: token is neither valid for managed cluster nor hub cluster")
-			return fmt.Errorf("authentication failed: token is neither valid for managed cluster nor hub cluster")
+			errs = append(errs, fmt.Errorf("hub %s: %v", hub.name, err))
+			continue
 		}
-
-		if err := s.processHubUser(req, hubUserInfo); err != nil {
-			klog.ErrorS(err, "failed to process hub user")
-			return fmt.Errorf("failed to process hub user: %v", err)
+		if authenticated {
+			return hub, userInfo, nil
 		}
 	}
-
-	return nil
+	return nil, nil, utilerrors.NewAggregate(errs)
 }
 
 // processHubUser handles the hub user specific operations including impersonation
-func (s *serviceProxy) processHubUser(req *http.Request, hubUserInfo *authenticationv1.UserInfo) error {
+func (s *serviceProxy) processHubUser(req *http.Request, hub *trustedHub, hubUserInfo *authenticationv1.UserInfo, backend *externalAPIServer) (err error) {
+	_, span := tracing.Start(req.Context(), "Impersonate")
+	defer func() { tracing.End(span, err) }()
+
 	// set impersonate group header
-	for _, group := range hubUserInfo.Groups {
+	for _, group := range hub.groups(hubUserInfo) {
 		// Here using `Add` instead of `Set` to support multiple groups
 		req.Header.Add("Impersonate-Group", group)
 	}
 
-	// check if the hub user is serviceaccount kind, if so, add "cluster:hub:" prefix to the username
-	if strings.HasPrefix(hubUserInfo.Username, "system:serviceaccount:") {
-		req.Header.Set("Impersonate-User", fmt.Sprintf("cluster:hub:%s", hubUserInfo.Username))
-	} else {
-		req.Header.Set("Impersonate-User", hubUserInfo.Username)
-	}
+	req.Header.Set("Impersonate-User", hub.username(hubUserInfo))
 
 	// replace the original token with cluster-proxy service-account token which has impersonate permission
-	token, err := s.getImpersonateToken()
+	token, err := s.getImpersonateToken(backend)
 	if err != nil {
 		return fmt.Errorf("failed to get impersonate token: %v", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+token)
+	if token == "" {
+		// the client certificate of the apiserver kubeconfig is presented instead
+		req.Header.Del("Authorization")
+	} else {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	if s.impersonateRequestID {
+		req.Header.Set(requestIDExtraHeader, req.Header.Get(utils.HeaderRequestID))
+	}
+
+	impersonationsTotal.WithLabelValues(strconv.FormatBool(isServiceAccountUser(hubUserInfo))).Inc()
 	return nil
 }
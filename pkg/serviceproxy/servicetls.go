@@ -0,0 +1,303 @@
+package serviceproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stolostron/cluster-proxy-addon/pkg/constant"
+	"github.com/stolostron/cluster-proxy-addon/pkg/tracing"
+	"github.com/stolostron/cluster-proxy-addon/pkg/utils"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// defaultCABundleKey is the key of the CA bundle in the ConfigMap of constant.AnnotationServiceCABundle if it is not set.
+const defaultCABundleKey = "ca.crt"
+
+type serviceTLSOptions struct {
+	// annotations enables the TLS configuration of the services by their annotations
+	annotations bool
+	// clientCertificates enables the client certificates of the services referenced by their annotations
+	clientCertificates bool
+	cacheTTL           time.Duration
+	// insecureServices are the namespace/name of the services which are not verified
+	insecureServices []string
+}
+
+func newServiceTLSOptions() *serviceTLSOptions {
+	return &serviceTLSOptions{cacheTTL: time.Minute}
+}
+
+func (o *serviceTLSOptions) addFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+
+	flags.BoolVar(&o.annotations, "service-tls-annotations", o.annotations, "Configure the TLS connections to the services by the annotations of the Services: "+
+		constant.AnnotationServiceCABundle+" references the ConfigMap, <name> or <name>/<key> (default key "+defaultCABundleKey+"), of the CA bundle the service is verified with, "+
+		"and "+constant.AnnotationServiceServerName+" overrides the server name. Requires the permission to get the Services and the ConfigMaps")
+	flags.BoolVar(&o.clientCertificates, "service-client-certificates", o.clientCertificates, "Present a client certificate to the services which require mTLS, the "+
+		constant.AnnotationServiceClientCertificate+" annotation of the Service references the kubernetes.io/tls Secret of the certificate in the namespace of the Service. "+
+		"It is only presented to the callers allowed to get services/proxy on the Service, the others are rejected. Requires the permission to get the Services and the Secrets, and to create the SubjectAccessReviews")
+	flags.DurationVar(&o.cacheTTL, "service-tls-cache-ttl", o.cacheTTL, "How long the TLS configuration of a service is cached before its annotations, CA bundle and client certificate are read again")
+	flags.StringSliceVar(&o.insecureServices, "insecure-skip-verify-service", o.insecureServices, "The namespace/name of a service whose certificate is not verified, e.g. a service with a self-signed certificate. "+
+		"It can be repeated")
+}
+
+func (o *serviceTLSOptions) validate() error {
+	for _, service := range o.insecureServices {
+		namespace, name, ok := strings.Cut(service, "/")
+		if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("invalid --insecure-skip-verify-service %q, it must be namespace/name", service)
+		}
+	}
+	if o.cacheTTL <= 0 {
+		return fmt.Errorf("--service-tls-cache-ttl must be positive")
+	}
+	return nil
+}
+
+// serviceTLS is the TLS configuration of a service read from its annotations.
+type serviceTLS struct {
+	// rootCAs is the CA bundle of the service, nil for the default root CAs
+	rootCAs    *x509.CertPool
+	serverName string
+	// certificate is the client certificate presented to the service, nil if none
+	certificate *tls.Certificate
+}
+
+type serviceTLSEntry struct {
+	tls *serviceTLS
+	// err is the failure to read the configuration, cached for serviceTLSErrorBackoff
+	err     error
+	expires time.Time
+}
+
+// serviceTLSErrorBackoff is how long the failure to read the TLS configuration of a service is cached, so that
+// the requests to a service missing its CA bundle or client certificate do not each read it again.
+const serviceTLSErrorBackoff = 10 * time.Second
+
+// serviceTLSConfigs returns the TLS configurations of the connections to the services. The configuration read from
+// the annotations of a service is cached for a while, so that the Service and its CA bundle are not read on each request.
+type serviceTLSConfigs struct {
+	// client reads the Services, the ConfigMaps and the Secrets, nil if the annotations are not enabled
+	client             kubernetes.Interface
+	annotations        bool
+	clientCertificates bool
+	ttl                time.Duration
+	insecure           sets.Set[string]
+	now                func() time.Time
+
+	lock    sync.Mutex
+	entries map[string]serviceTLSEntry
+}
+
+func newServiceTLSConfigs(o *serviceTLSOptions, client kubernetes.Interface) *serviceTLSConfigs {
+	c := &serviceTLSConfigs{
+		annotations:        o.annotations,
+		clientCertificates: o.clientCertificates,
+		ttl:                o.cacheTTL,
+		insecure:           sets.New(o.insecureServices...),
+		now:                time.Now,
+		entries:            map[string]serviceTLSEntry{},
+	}
+	if o.annotations || o.clientCertificates {
+		c.client = client
+	}
+	return c
+}
+
+// tlsConfig returns the TLS configuration of the connections to the service, rootCAs are the default root CAs.
+func (c *serviceTLSConfigs) tlsConfig(ctx context.Context, namespace, name string, rootCAs *x509.CertPool) (*tls.Config, error) {
+	config := &tls.Config{
+		RootCAs:    rootCAs,
+		MinVersion: tls.VersionTLS12,
+	}
+	if c == nil {
+		return config, nil
+	}
+	if c.insecure.Has(namespace + "/" + name) {
+		config.InsecureSkipVerify = true
+	}
+	if c.client == nil {
+		return config, nil
+	}
+
+	serviceTLS, err := c.get(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	if serviceTLS.rootCAs != nil {
+		config.RootCAs = serviceTLS.rootCAs
+	}
+	config.ServerName = serviceTLS.serverName
+	if certificate := serviceTLS.certificate; certificate != nil {
+		// the certificate is presented even if it is not issued by one of the CAs the service asks for
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return certificate, nil
+		}
+	}
+	return config, nil
+}
+
+// get returns the cached TLS configuration of the service, or reads it if it is expired. The errors are cached
+// for serviceTLSErrorBackoff, or the ttl if shorter, so a missing CA bundle is read again soon after it is created.
+func (c *serviceTLSConfigs) get(ctx context.Context, namespace, name string) (*serviceTLS, error) {
+	key := namespace + "/" + name
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	c.lock.Unlock()
+	if ok && c.now().Before(entry.expires) {
+		return entry.tls, entry.err
+	}
+
+	serviceTLS, err := c.read(ctx, namespace, name)
+	ttl := c.ttl
+	if err != nil && ttl > serviceTLSErrorBackoff {
+		ttl = serviceTLSErrorBackoff
+	}
+	if err != nil && ctx.Err() != nil {
+		// the request is gone, it tells nothing about the service
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	// drop the expired entries, so the services removed since are not kept forever
+	now := c.now()
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = serviceTLSEntry{tls: serviceTLS, err: err, expires: now.Add(ttl)}
+	return serviceTLS, err
+}
+
+// read reads the TLS configuration of the service from its annotations.
+func (c *serviceTLSConfigs) read(ctx context.Context, namespace, name string) (*serviceTLS, error) {
+	service, err := c.client.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		// the connection to the service fails anyway
+		return &serviceTLS{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the service %s/%s: %v", namespace, name, err)
+	}
+
+	serviceTLS := &serviceTLS{}
+	if c.annotations {
+		if err := c.readTrust(ctx, service, serviceTLS); err != nil {
+			return nil, err
+		}
+	}
+	if secretName, ok := service.Annotations[constant.AnnotationServiceClientCertificate]; ok && c.clientCertificates {
+		// the Secret is only looked up in the namespace of the Service, whose owner can already read it
+		secret, err := c.client.CoreV1().Secrets(namespace).Get(ctx, secretName, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the client certificate of the service %s/%s: %v", namespace, name, err)
+		}
+		certificate, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate %s of the service %s/%s: %v", secretName, namespace, name, err)
+		}
+		serviceTLS.certificate = &certificate
+	}
+
+	klog.V(4).InfoS("read the TLS configuration of the service", "namespace", namespace, "name", name,
+		"caBundle", serviceTLS.rootCAs != nil, "serverName", serviceTLS.serverName, "clientCertificate", serviceTLS.certificate != nil)
+	return serviceTLS, nil
+}
+
+// readTrust reads the CA bundle and the server name the service is verified with.
+func (c *serviceTLSConfigs) readTrust(ctx context.Context, service *corev1.Service, serviceTLS *serviceTLS) error {
+	namespace, name := service.Namespace, service.Name
+	serviceTLS.serverName = service.Annotations[constant.AnnotationServiceServerName]
+	if reference, ok := service.Annotations[constant.AnnotationServiceCABundle]; ok {
+		configMapName, key, _ := strings.Cut(reference, "/")
+		if key == "" {
+			key = defaultCABundleKey
+		}
+		configMap, err := c.client.CoreV1().ConfigMaps(namespace).Get(ctx, configMapName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get the CA bundle of the service %s/%s: %v", namespace, name, err)
+		}
+		serviceTLS.rootCAs = x509.NewCertPool()
+		if !serviceTLS.rootCAs.AppendCertsFromPEM([]byte(configMap.Data[key])) {
+			return fmt.Errorf("no certificate in the CA bundle %s/%s of the service %s/%s", configMapName, key, namespace, name)
+		}
+	}
+	return nil
+}
+
+// authorizeClientCertificate returns an error, with the status code of the response, unless the caller is allowed to
+// get services/proxy on the service, before the client certificate of the service is presented on its behalf. The
+// service trusts the certificate, so the callers which could not reach it through the kube-apiserver proxy must not
+// reach it through the service-proxy either. The token of the request is reviewed as for the kube-apiserver, by the
+// managed cluster then by the hubs, and the access of the user is reviewed by the managed cluster, the users of a hub
+// with the identity they are impersonated with.
+func (s *serviceProxy) authorizeClientCertificate(req *http.Request, namespace, service string) (code int, err error) {
+	ctx, span := tracing.Start(req.Context(), "AuthorizeClientCertificate")
+	defer func() { tracing.End(span, err) }()
+
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "Bearer ") {
+		return http.StatusUnauthorized, fmt.Errorf("a token is required to reach the service %s/%s with its client certificate", namespace, service)
+	}
+	backend, err := s.apiServerFor(utils.GetTargetClusterFromRequest(req))
+	if err != nil {
+		return http.StatusNotFound, err
+	}
+	hub, userInfo, err := s.authenticate(req, backend)
+	if err != nil {
+		return http.StatusUnauthorized, err
+	}
+
+	spec := authorizationv1.SubjectAccessReviewSpec{
+		User:   userInfo.Username,
+		Groups: userInfo.Groups,
+		UID:    userInfo.UID,
+		ResourceAttributes: &authorizationv1.ResourceAttributes{
+			Namespace:   namespace,
+			Verb:        "get",
+			Resource:    "services",
+			Subresource: "proxy",
+			Name:        service,
+		},
+	}
+	if hub != nil {
+		spec.User, spec.Groups, spec.UID = hub.username(userInfo), hub.groups(userInfo), ""
+	} else {
+		spec.Extra = extraValues(userInfo.Extra)
+	}
+	review, err := s.managedClusterClient(backend).AuthorizationV1().SubjectAccessReviews().Create(ctx,
+		&authorizationv1.SubjectAccessReview{Spec: spec}, metav1.CreateOptions{})
+	if err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("failed to review the access of %s to the service %s/%s: %v", spec.User, namespace, service, err)
+	}
+	if !review.Status.Allowed {
+		return http.StatusForbidden, fmt.Errorf("%s is not allowed to get services/proxy %s in the namespace %s", spec.User, service, namespace)
+	}
+	return http.StatusOK, nil
+}
+
+func extraValues(extra map[string]authenticationv1.ExtraValue) map[string]authorizationv1.ExtraValue {
+	if len(extra) == 0 {
+		return nil
+	}
+	values := make(map[string]authorizationv1.ExtraValue, len(extra))
+	for key, value := range extra {
+		values[key] = authorizationv1.ExtraValue(value)
+	}
+	return values
+}
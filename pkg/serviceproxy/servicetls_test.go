@@ -0,0 +1,435 @@
+package serviceproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stolostron/cluster-proxy-addon/pkg/constant"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/cert"
+)
+
+// newTestKubeClient returns a client of a kube-apiserver serving the objects by their path, e.g.
+// /api/v1/namespaces/default/services/nginx, and counting the requests.
+func newTestKubeClient(t *testing.T, objects map[string]interface{}) (kubernetes.Interface, *atomic.Int32) {
+	requests := &atomic.Int32{}
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		obj, ok := objects[r.URL.Path]
+		if !ok {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			_ = json.NewEncoder(w).Encode(&metav1.Status{Status: metav1.StatusFailure, Reason: metav1.StatusReasonNotFound, Code: http.StatusNotFound})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(obj)
+	}))
+	t.Cleanup(apiServer.Close)
+
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: apiServer.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, requests
+}
+
+func TestServiceTLSConfigs(t *testing.T) {
+	caPEM, _, err := cert.GenerateSelfSignedCertKey("private-ca", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultRootCAs := x509.NewCertPool()
+
+	service := func(name string, annotations map[string]string) *corev1.Service {
+		return &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Annotations: annotations}}
+	}
+	client, _ := newTestKubeClient(t, map[string]interface{}{
+		"/api/v1/namespaces/default/services/plain": service("plain", nil),
+		"/api/v1/namespaces/default/services/private": service("private", map[string]string{
+			constant.AnnotationServiceCABundle:   "private-ca",
+			constant.AnnotationServiceServerName: "private.example.com",
+		}),
+		"/api/v1/namespaces/default/services/custom-key": service("custom-key", map[string]string{
+			constant.AnnotationServiceCABundle: "trust-bundle/bundle.pem",
+		}),
+		"/api/v1/namespaces/default/services/missing-bundle": service("missing-bundle", map[string]string{
+			constant.AnnotationServiceCABundle: "missing",
+		}),
+		"/api/v1/namespaces/default/services/empty-bundle": service("empty-bundle", map[string]string{
+			constant.AnnotationServiceCABundle: "private-ca/other.crt",
+		}),
+		"/api/v1/namespaces/default/configmaps/private-ca": &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "private-ca"},
+			Data:       map[string]string{defaultCABundleKey: string(caPEM)},
+		},
+		"/api/v1/namespaces/default/configmaps/trust-bundle": &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "trust-bundle"},
+			Data:       map[string]string{"bundle.pem": string(caPEM)},
+		},
+	})
+
+	testcases := []struct {
+		name             string
+		options          *serviceTLSOptions
+		service          string
+		expectErr        bool
+		expectCABundle   bool
+		expectServerName string
+		expectInsecure   bool
+	}{
+		{
+			name:    "annotations disabled",
+			options: &serviceTLSOptions{cacheTTL: time.Minute},
+			service: "private",
+		},
+		{
+			name:    "no annotations",
+			options: &serviceTLSOptions{annotations: true, cacheTTL: time.Minute},
+			service: "plain",
+		},
+		{
+			name:             "CA bundle and server name",
+			options:          &serviceTLSOptions{annotations: true, cacheTTL: time.Minute},
+			service:          "private",
+			expectCABundle:   true,
+			expectServerName: "private.example.com",
+		},
+		{
+			name:           "CA bundle key",
+			options:        &serviceTLSOptions{annotations: true, cacheTTL: time.Minute},
+			service:        "custom-key",
+			expectCABundle: true,
+		},
+		{
+			name:      "missing CA bundle",
+			options:   &serviceTLSOptions{annotations: true, cacheTTL: time.Minute},
+			service:   "missing-bundle",
+			expectErr: true,
+		},
+		{
+			name:      "empty CA bundle",
+			options:   &serviceTLSOptions{annotations: true, cacheTTL: time.Minute},
+			service:   "empty-bundle",
+			expectErr: true,
+		},
+		{
+			name:    "service not found",
+			options: &serviceTLSOptions{annotations: true, cacheTTL: time.Minute},
+			service: "unknown",
+		},
+		{
+			name:           "insecure",
+			options:        &serviceTLSOptions{cacheTTL: time.Minute, insecureServices: []string{"default/plain"}},
+			service:        "plain",
+			expectInsecure: true,
+		},
+		{
+			name:    "insecure in another namespace",
+			options: &serviceTLSOptions{cacheTTL: time.Minute, insecureServices: []string{"other/plain"}},
+			service: "plain",
+		},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.name, func(t *testing.T) {
+			configs := newServiceTLSConfigs(c.options, client)
+			config, err := configs.tlsConfig(t.Context(), "default", c.service, defaultRootCAs)
+			if c.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if caBundle := config.RootCAs != defaultRootCAs; caBundle != c.expectCABundle {
+				t.Errorf("expected CA bundle %v, got %v", c.expectCABundle, caBundle)
+			}
+			if config.ServerName != c.expectServerName {
+				t.Errorf("expected server name %q, got %q", c.expectServerName, config.ServerName)
+			}
+			if config.InsecureSkipVerify != c.expectInsecure {
+				t.Errorf("expected insecure %v, got %v", c.expectInsecure, config.InsecureSkipVerify)
+			}
+		})
+	}
+}
+
+func TestServiceTLSConfigsCache(t *testing.T) {
+	client, requests := newTestKubeClient(t, map[string]interface{}{
+		"/api/v1/namespaces/default/services/nginx": &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx", Annotations: map[string]string{
+				constant.AnnotationServiceServerName: "nginx.example.com",
+			}},
+		},
+	})
+
+	now := time.Now()
+	configs := newServiceTLSConfigs(&serviceTLSOptions{annotations: true, cacheTTL: time.Minute}, client)
+	configs.now = func() time.Time { return now }
+
+	for i, expect := range []int32{1, 1, 2} {
+		if i == 2 {
+			now = now.Add(time.Minute)
+		}
+		config, err := configs.tlsConfig(t.Context(), "default", "nginx", nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if config.ServerName != "nginx.example.com" {
+			t.Errorf("expected server name nginx.example.com, got %q", config.ServerName)
+		}
+		if actual := requests.Load(); actual != expect {
+			t.Errorf("expected %d requests to the kube-apiserver, got %d", expect, actual)
+		}
+	}
+}
+
+func TestServiceTLSConfigsErrorBackoff(t *testing.T) {
+	client, requests := newTestKubeClient(t, map[string]interface{}{
+		"/api/v1/namespaces/default/services/nginx": &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "nginx", Annotations: map[string]string{
+				constant.AnnotationServiceCABundle: "missing-ca",
+			}},
+		},
+	})
+
+	now := time.Now()
+	configs := newServiceTLSConfigs(&serviceTLSOptions{annotations: true, cacheTTL: time.Minute}, client)
+	configs.now = func() time.Time { return now }
+
+	// the Service and the ConfigMap are read once per backoff
+	for i, expect := range []int32{2, 2, 4} {
+		if i == 2 {
+			now = now.Add(serviceTLSErrorBackoff)
+		}
+		if _, err := configs.tlsConfig(t.Context(), "default", "nginx", nil); err == nil {
+			t.Errorf("expected error, got nil")
+		}
+		if actual := requests.Load(); actual != expect {
+			t.Errorf("expected %d requests to the kube-apiserver, got %d", expect, actual)
+		}
+	}
+}
+
+func TestServiceTLSConfigsClientCertificate(t *testing.T) {
+	certPEM, keyPEM, err := cert.GenerateSelfSignedCertKey("cluster-proxy", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := func(name string, annotations map[string]string) *corev1.Service {
+		return &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Annotations: annotations}}
+	}
+	client, _ := newTestKubeClient(t, map[string]interface{}{
+		"/api/v1/namespaces/default/services/plain": service("plain", nil),
+		"/api/v1/namespaces/default/services/mtls": service("mtls", map[string]string{
+			constant.AnnotationServiceClientCertificate: "mtls-client",
+		}),
+		"/api/v1/namespaces/default/services/missing-secret": service("missing-secret", map[string]string{
+			constant.AnnotationServiceClientCertificate: "missing",
+		}),
+		"/api/v1/namespaces/default/services/invalid-secret": service("invalid-secret", map[string]string{
+			constant.AnnotationServiceClientCertificate: "invalid",
+		}),
+		"/api/v1/namespaces/default/secrets/mtls-client": &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "mtls-client"},
+			Type:       corev1.SecretTypeTLS,
+			Data:       map[string][]byte{corev1.TLSCertKey: certPEM, corev1.TLSPrivateKeyKey: keyPEM},
+		},
+		"/api/v1/namespaces/default/secrets/invalid": &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "invalid"},
+			Data:       map[string][]byte{corev1.TLSCertKey: certPEM},
+		},
+	})
+
+	// the service which requires a client certificate, and replies with its common name
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	upstream.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	upstream.StartTLS()
+	defer upstream.Close()
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(upstream.Certificate())
+
+	testcases := []struct {
+		name         string
+		options      *serviceTLSOptions
+		service      string
+		expectErr    bool
+		expectClient string
+	}{
+		{
+			name:    "disabled",
+			options: &serviceTLSOptions{cacheTTL: time.Minute},
+			service: "mtls",
+		},
+		{
+			name:    "no annotation",
+			options: &serviceTLSOptions{clientCertificates: true, cacheTTL: time.Minute},
+			service: "plain",
+		},
+		{
+			name:         "client certificate",
+			options:      &serviceTLSOptions{clientCertificates: true, cacheTTL: time.Minute},
+			service:      "mtls",
+			expectClient: "cluster-proxy",
+		},
+		{
+			name:      "missing secret",
+			options:   &serviceTLSOptions{clientCertificates: true, cacheTTL: time.Minute},
+			service:   "missing-secret",
+			expectErr: true,
+		},
+		{
+			name:      "invalid secret",
+			options:   &serviceTLSOptions{clientCertificates: true, cacheTTL: time.Minute},
+			service:   "invalid-secret",
+			expectErr: true,
+		},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.name, func(t *testing.T) {
+			configs := newServiceTLSConfigs(c.options, client)
+			config, err := configs.tlsConfig(t.Context(), "default", c.service, rootCAs)
+			if c.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+
+			resp, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: config}}).Get(upstream.URL)
+			if c.expectClient == "" {
+				if err == nil {
+					resp.Body.Close()
+					t.Errorf("expected the handshake to fail without client certificate, got %s", resp.Status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the common name of the self-signed certificates has a timestamp suffix
+			if !strings.HasPrefix(string(body), c.expectClient+"@") {
+				t.Errorf("expected client certificate %s, got %s", c.expectClient, body)
+			}
+		})
+	}
+}
+
+// newTestReviewClient returns a client of a kube-apiserver authenticating the tokens by the users and allowing the
+// subject access reviews of the allowed users.
+func newTestReviewClient(t *testing.T, users map[string]authenticationv1.UserInfo, allowed ...string) kubernetes.Interface {
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var review interface{}
+		switch r.URL.Path {
+		case "/apis/authentication.k8s.io/v1/tokenreviews":
+			tokenReview := &authenticationv1.TokenReview{}
+			if err := json.NewDecoder(r.Body).Decode(tokenReview); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if user, ok := users[tokenReview.Spec.Token]; ok {
+				tokenReview.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: user}
+			}
+			review = tokenReview
+		case "/apis/authorization.k8s.io/v1/subjectaccessreviews":
+			accessReview := &authorizationv1.SubjectAccessReview{}
+			if err := json.NewDecoder(r.Body).Decode(accessReview); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			attributes := accessReview.Spec.ResourceAttributes
+			accessReview.Status.Allowed = slices.Contains(allowed, accessReview.Spec.User) && attributes.Verb == "get" &&
+				attributes.Resource == "services" && attributes.Subresource == "proxy" && attributes.Namespace == "default" && attributes.Name == "mtls"
+			review = accessReview
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(review)
+	}))
+	t.Cleanup(apiServer.Close)
+
+	client, err := kubernetes.NewForConfig(&rest.Config{Host: apiServer.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func TestAuthorizeClientCertificate(t *testing.T) {
+	managedClient := newTestReviewClient(t, map[string]authenticationv1.UserInfo{
+		"alice": {Username: "alice"},
+		"bob":   {Username: "bob"},
+	}, "alice", "cluster:hub-b:carol")
+	hubClient := &kubeconfigClient{}
+	hubClient.state.Store(&kubeconfigState{client: newTestReviewClient(t, map[string]authenticationv1.UserInfo{
+		"carol": {Username: "carol", Groups: []string{"admins"}},
+		"dave":  {Username: "dave"},
+	})})
+	s := &serviceProxy{
+		managedClusterKubeClient: managedClient,
+		hubs: []*trustedHub{
+			{name: "hub-b", identityPrefix: "cluster:hub-b:", identityPrefixScope: identityPrefixAll, enabled: true, client: hubClient},
+		},
+	}
+
+	testcases := []struct {
+		name       string
+		token      string
+		service    string
+		expectCode int
+	}{
+		{name: "no token", service: "mtls", expectCode: http.StatusUnauthorized},
+		{name: "not authenticated", token: "token-of-the-service", service: "mtls", expectCode: http.StatusUnauthorized},
+		{name: "managed cluster user not authorized", token: "bob", service: "mtls", expectCode: http.StatusForbidden},
+		{name: "managed cluster user authorized", token: "alice", service: "mtls", expectCode: http.StatusOK},
+		{name: "managed cluster user not authorized on another service", token: "alice", service: "other", expectCode: http.StatusForbidden},
+		{name: "hub user not authorized", token: "dave", service: "mtls", expectCode: http.StatusForbidden},
+		{name: "hub user authorized with its prefixed identity", token: "carol", service: "mtls", expectCode: http.StatusOK},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "https://cluster-proxy-service-proxy:7443/", nil)
+			if c.token != "" {
+				req.Header.Set("Authorization", "Bearer "+c.token)
+			}
+			code, err := s.authorizeClientCertificate(req, "default", c.service)
+			if code != c.expectCode {
+				t.Errorf("expected code %d, got %d: %v", c.expectCode, code, err)
+			}
+			if (err == nil) != (c.expectCode == http.StatusOK) {
+				t.Errorf("expected error %v, got %v", c.expectCode != http.StatusOK, err)
+			}
+		})
+	}
+}
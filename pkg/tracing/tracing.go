@@ -0,0 +1,122 @@
+package tracing
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+
+	"github.com/spf13/cobra"
+	"github.com/stolostron/cluster-proxy-addon/pkg/version"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/klog/v2"
+)
+
+const instrumentationName = "github.com/stolostron/cluster-proxy-addon"
+
+// Options holds the configuration of the OTLP trace exporter.
+type Options struct {
+	// Endpoint is the OTLP gRPC endpoint (host:port) spans are exported to. Tracing is disabled when it is empty.
+	Endpoint string
+	// Insecure disables TLS when connecting to the endpoint.
+	Insecure bool
+	// SamplingRatio is the ratio of new traces to sample. Traces started by the client are sampled according to the parent.
+	SamplingRatio float64
+}
+
+func NewOptions() *Options {
+	return &Options{
+		SamplingRatio: 0.0001,
+	}
+}
+
+func (o *Options) AddFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+
+	flags.StringVar(&o.Endpoint, "tracing-endpoint", o.Endpoint, "The OTLP gRPC endpoint (host:port) traces are exported to, tracing is disabled if not set")
+	flags.BoolVar(&o.Insecure, "tracing-insecure", o.Insecure, "Connect to the tracing endpoint without TLS")
+	flags.Float64Var(&o.SamplingRatio, "tracing-sampling-ratio", o.SamplingRatio, "The ratio of requests without a sampled trace context that start a new trace, between 0 and 1")
+}
+
+func (o *Options) Validate() error {
+	if o.SamplingRatio < 0 || o.SamplingRatio > 1 {
+		return fmt.Errorf("the tracing-sampling-ratio must be between 0 and 1")
+	}
+	return nil
+}
+
+// Init configures the global W3C trace context propagator and, if an endpoint is configured, the
+// global tracer provider exporting spans via OTLP. The returned function flushes and stops the exporter.
+func Init(ctx context.Context, serviceName string, o *Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if o.Endpoint == "" {
+		klog.Info("tracing-endpoint is not provided, tracing is disabled")
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporterOpts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(o.Endpoint)}
+	if o.Insecure {
+		exporterOpts = append(exporterOpts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, exporterOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create otlp trace exporter: %v", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(serviceName),
+		semconv.ServiceVersion(version.Get().GitVersion),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(o.SamplingRatio))),
+	)
+	otel.SetTracerProvider(tp)
+
+	klog.Infof("tracing is enabled, exporting spans to %s", o.Endpoint)
+	return tp.Shutdown, nil
+}
+
+// Start starts a span named name as a child of the span in ctx, if any.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// End records err on the span, if any, and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// WithTLSHandshakeSpan returns a context that records a span for every TLS handshake of the
+// http requests made with it.
+func WithTLSHandshakeSpan(ctx context.Context, name string) context.Context {
+	var span trace.Span
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			_, span = Start(ctx, name)
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if span != nil {
+				End(span, err)
+			}
+		},
+	})
+}
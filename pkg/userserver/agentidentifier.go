@@ -0,0 +1,159 @@
+package userserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/stolostron/cluster-proxy-addon/pkg/constant"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic"
+
+	clusterlisterv1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1"
+)
+
+// agent identifier strategies, they must match the agent identifiers the proxy-agents register with to the
+// ANP proxy-server, which routes the requests to the proxy-agent by the host of the service-proxy.
+const (
+	// agentIdentifierStrategyHash is the identifier of cluster-proxy, cluster-<sha256 of the cluster name> truncated.
+	agentIdentifierStrategyHash = "hash"
+	// agentIdentifierStrategyClusterName is the name of the cluster.
+	agentIdentifierStrategyClusterName = "cluster-name"
+	// agentIdentifierStrategyClaim is the value of a ClusterClaim of the ManagedCluster.
+	agentIdentifierStrategyClaim = "claim"
+)
+
+// serviceProxyHostSuffix is appended to the agent identifier, the certificate of the service-proxy is valid for
+// *.open-cluster-management.proxy.
+const serviceProxyHostSuffix = ".open-cluster-management.proxy"
+
+var managedProxyConfigurationGVR = schema.GroupVersionResource{
+	Group:    "proxy.open-cluster-management.io",
+	Version:  "v1alpha1",
+	Resource: "managedproxyconfigurations",
+}
+
+type agentIdentifierOptions struct {
+	strategy string
+	claim    string
+}
+
+func newAgentIdentifierOptions() *agentIdentifierOptions {
+	return &agentIdentifierOptions{
+		strategy: agentIdentifierStrategyHash,
+	}
+}
+
+func (o *agentIdentifierOptions) addFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+
+	flags.StringVar(&o.strategy, "agent-identifier-strategy", o.strategy, "How the agent identifier of the proxy-agent of a cluster, the host of its service-proxy, is derived from the cluster: "+
+		"hash (cluster-<sha256 of the cluster name>, as cluster-proxy), cluster-name, or claim (the value of the ClusterClaim --agent-identifier-claim of the ManagedCluster). "+
+		"It is checked at startup against the annotations of the ManagedProxyConfiguration "+constant.ManagedProxyConfigurationName)
+	flags.StringVar(&o.claim, "agent-identifier-claim", o.claim, "The name of the ClusterClaim holding the agent identifier, with --agent-identifier-strategy=claim")
+}
+
+func (o *agentIdentifierOptions) validate() error {
+	switch o.strategy {
+	case agentIdentifierStrategyHash, agentIdentifierStrategyClusterName:
+		if o.claim != "" {
+			return fmt.Errorf("--agent-identifier-claim is only used with --agent-identifier-strategy=%s", agentIdentifierStrategyClaim)
+		}
+	case agentIdentifierStrategyClaim:
+		if o.claim == "" {
+			return fmt.Errorf("--agent-identifier-claim is required with --agent-identifier-strategy=%s", agentIdentifierStrategyClaim)
+		}
+	default:
+		return fmt.Errorf("invalid --agent-identifier-strategy %q, it must be %s, %s or %s", o.strategy,
+			agentIdentifierStrategyHash, agentIdentifierStrategyClusterName, agentIdentifierStrategyClaim)
+	}
+	return nil
+}
+
+// checkManagedProxyConfiguration returns an error if the strategy differs from the one the ManagedProxyConfiguration
+// is annotated with, or if it is not annotated, so that the user-server does not silently route the requests to
+// agent identifiers the proxy-agents are not registered with.
+func (o *agentIdentifierOptions) checkManagedProxyConfiguration(ctx context.Context, dynamicClient dynamic.Interface) error {
+	config, err := dynamicClient.Resource(managedProxyConfigurationGVR).Get(ctx, constant.ManagedProxyConfigurationName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get the ManagedProxyConfiguration %s: %v", constant.ManagedProxyConfigurationName, err)
+	}
+
+	annotations := config.GetAnnotations()
+	strategy, ok := annotations[constant.AnnotationAgentIdentifierStrategy]
+	if !ok {
+		return fmt.Errorf("the ManagedProxyConfiguration %s has no %s annotation, the agent identifier strategy %q can not be checked",
+			constant.ManagedProxyConfigurationName, constant.AnnotationAgentIdentifierStrategy, o.strategy)
+	}
+	claim := annotations[constant.AnnotationAgentIdentifierClaim]
+	if strategy != o.strategy || claim != o.claim {
+		return fmt.Errorf("the agent identifier strategy %q (claim %q) does not match the strategy %q (claim %q) of the ManagedProxyConfiguration %s",
+			o.strategy, o.claim, strategy, claim, constant.ManagedProxyConfigurationName)
+	}
+	return nil
+}
+
+// agentIdentifiers derives the agent identifier of the proxy-agent of a cluster.
+type agentIdentifiers struct {
+	strategy string
+	claim    string
+	// clusterLister is only set with the claim strategy
+	clusterLister clusterlisterv1.ManagedClusterLister
+}
+
+func newAgentIdentifiers(o *agentIdentifierOptions, clusterLister clusterlisterv1.ManagedClusterLister) *agentIdentifiers {
+	return &agentIdentifiers{
+		strategy:      o.strategy,
+		claim:         o.claim,
+		clusterLister: clusterLister,
+	}
+}
+
+// identifier returns the agent identifier of the proxy-agent of the cluster.
+func (a *agentIdentifiers) identifier(cluster string) (string, error) {
+	var identifier string
+	switch a.strategy {
+	case agentIdentifierStrategyClusterName:
+		identifier = cluster
+	case agentIdentifierStrategyClaim:
+		managedCluster, err := a.clusterLister.Get(cluster)
+		if err != nil {
+			return "", fmt.Errorf("failed to get the ManagedCluster %s: %v", cluster, err)
+		}
+		for _, claim := range managedCluster.Status.ClusterClaims {
+			if claim.Name == a.claim {
+				identifier = claim.Value
+				break
+			}
+		}
+		if identifier == "" {
+			return "", fmt.Errorf("the ManagedCluster %s has no ClusterClaim %s", cluster, a.claim)
+		}
+	default:
+		return hashAgentIdentifier(cluster), nil
+	}
+
+	if errs := validation.IsDNS1123Label(identifier); len(errs) > 0 {
+		return "", fmt.Errorf("the agent identifier %q of the cluster %s is invalid: %s", identifier, cluster, strings.Join(errs, ", "))
+	}
+	return identifier, nil
+}
+
+// serviceProxyURL returns the URL of the service-proxy of the cluster, which the ANP proxy-server routes by its host.
+func (a *agentIdentifiers) serviceProxyURL(cluster string) (string, error) {
+	identifier, err := a.identifier(cluster)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("https://%s%s:%d", identifier, serviceProxyHostSuffix, constant.ServiceProxyPort), nil
+}
+
+// here use the same logic as in the cluster-proxy repo:
+// https://github.com/stolostron/cluster-proxy/blob/304b2ded6c1a651be9ba0f15af4edf1f65ac29df/pkg/proxyagent/agent/agent.go#L297
+func hashAgentIdentifier(cluster string) string {
+	return fmt.Sprintf("cluster-%x", sha256.Sum256([]byte(cluster)))[:64-len("cluster-")]
+}
@@ -0,0 +1,205 @@
+package userserver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stolostron/cluster-proxy-addon/pkg/constant"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/tools/cache"
+
+	clusterlisterv1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1"
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+func TestAgentIdentifier(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, cluster := range []*clusterv1.ManagedCluster{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster1"},
+			Status: clusterv1.ManagedClusterStatus{
+				ClusterClaims: []clusterv1.ManagedClusterClaim{{Name: "id.k8s.io", Value: "c0ffee"}},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster2"},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster3"},
+			Status: clusterv1.ManagedClusterStatus{
+				ClusterClaims: []clusterv1.ManagedClusterClaim{{Name: "id.k8s.io", Value: "Not_A_Label"}},
+			},
+		},
+	} {
+		if err := indexer.Add(cluster); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lister := clusterlisterv1.NewManagedClusterLister(indexer)
+
+	testcases := []struct {
+		name      string
+		strategy  string
+		claim     string
+		cluster   string
+		expect    string
+		expectErr bool
+	}{
+		{
+			name:     "hash",
+			strategy: agentIdentifierStrategyHash,
+			cluster:  "cluster1",
+			expect:   "cluster-a140791d2b20a847f2c74c62c384f93fb83691d871e80385",
+		},
+		{
+			name:     "cluster name",
+			strategy: agentIdentifierStrategyClusterName,
+			cluster:  "cluster1",
+			expect:   "cluster1",
+		},
+		{
+			name:      "invalid cluster name",
+			strategy:  agentIdentifierStrategyClusterName,
+			cluster:   "cluster.example.com",
+			expectErr: true,
+		},
+		{
+			name:     "claim",
+			strategy: agentIdentifierStrategyClaim,
+			claim:    "id.k8s.io",
+			cluster:  "cluster1",
+			expect:   "c0ffee",
+		},
+		{
+			name:      "missing claim",
+			strategy:  agentIdentifierStrategyClaim,
+			claim:     "id.k8s.io",
+			cluster:   "cluster2",
+			expectErr: true,
+		},
+		{
+			name:      "invalid claim",
+			strategy:  agentIdentifierStrategyClaim,
+			claim:     "id.k8s.io",
+			cluster:   "cluster3",
+			expectErr: true,
+		},
+		{
+			name:      "unknown cluster",
+			strategy:  agentIdentifierStrategyClaim,
+			claim:     "id.k8s.io",
+			cluster:   "cluster4",
+			expectErr: true,
+		},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.name, func(t *testing.T) {
+			identifiers := newAgentIdentifiers(&agentIdentifierOptions{strategy: c.strategy, claim: c.claim}, lister)
+			actual, err := identifiers.identifier(c.cluster)
+			if c.expectErr {
+				if err == nil {
+					t.Errorf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if actual != c.expect {
+				t.Errorf("expected %s, got %s", c.expect, actual)
+			}
+		})
+	}
+}
+
+func TestServiceProxyURL(t *testing.T) {
+	identifiers := newAgentIdentifiers(newAgentIdentifierOptions(), nil)
+	actual, err := identifiers.serviceProxyURL("cluster1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// the host cluster-proxy registers the proxy-agent of cluster1 with
+	expect := "https://cluster-a140791d2b20a847f2c74c62c384f93fb83691d871e80385.open-cluster-management.proxy:7443"
+	if actual != expect {
+		t.Errorf("expected %s, got %s", expect, actual)
+	}
+}
+
+func TestCheckManagedProxyConfiguration(t *testing.T) {
+	testcases := []struct {
+		name        string
+		annotations map[string]string
+		missing     bool
+		options     *agentIdentifierOptions
+		expectErr   bool
+	}{
+		{
+			name:      "not found",
+			missing:   true,
+			options:   &agentIdentifierOptions{strategy: agentIdentifierStrategyHash},
+			expectErr: true,
+		},
+		{
+			name:      "not annotated",
+			options:   &agentIdentifierOptions{strategy: agentIdentifierStrategyHash},
+			expectErr: true,
+		},
+		{
+			name:        "hash",
+			annotations: map[string]string{constant.AnnotationAgentIdentifierStrategy: agentIdentifierStrategyHash},
+			options:     &agentIdentifierOptions{strategy: agentIdentifierStrategyHash},
+		},
+		{
+			name:        "hash mismatch",
+			annotations: map[string]string{constant.AnnotationAgentIdentifierStrategy: agentIdentifierStrategyHash},
+			options:     &agentIdentifierOptions{strategy: agentIdentifierStrategyClusterName},
+			expectErr:   true,
+		},
+		{
+			name: "claim",
+			annotations: map[string]string{
+				constant.AnnotationAgentIdentifierStrategy: agentIdentifierStrategyClaim,
+				constant.AnnotationAgentIdentifierClaim:    "id.k8s.io",
+			},
+			options: &agentIdentifierOptions{strategy: agentIdentifierStrategyClaim, claim: "id.k8s.io"},
+		},
+		{
+			name: "claim mismatch",
+			annotations: map[string]string{
+				constant.AnnotationAgentIdentifierStrategy: agentIdentifierStrategyClaim,
+				constant.AnnotationAgentIdentifierClaim:    "id.k8s.io",
+			},
+			options:   &agentIdentifierOptions{strategy: agentIdentifierStrategyClaim, claim: "id.openshift.io"},
+			expectErr: true,
+		},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.name, func(t *testing.T) {
+			objects := []runtime.Object{}
+			if !c.missing {
+				config := &unstructured.Unstructured{}
+				config.SetAPIVersion("proxy.open-cluster-management.io/v1alpha1")
+				config.SetKind("ManagedProxyConfiguration")
+				config.SetName(constant.ManagedProxyConfigurationName)
+				config.SetAnnotations(c.annotations)
+				objects = append(objects, config)
+			}
+			client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+				map[schema.GroupVersionResource]string{managedProxyConfigurationGVR: "ManagedProxyConfigurationList"}, objects...)
+
+			err := c.options.checkManagedProxyConfiguration(context.Background(), client)
+			if c.expectErr && err == nil {
+				t.Errorf("expected error, got nil")
+			}
+			if !c.expectErr && err != nil {
+				t.Errorf("expected no error, got %v", err)
+			}
+		})
+	}
+}
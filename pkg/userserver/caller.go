@@ -0,0 +1,124 @@
+package userserver
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// anonymousCaller is the caller of requests without a bearer token.
+	anonymousCaller = "system:anonymous"
+
+	// maxCachedCallers caps the cache, the tokens reviewed while it is full are not cached.
+	maxCachedCallers = 10000
+
+	callerTTL = time.Minute
+)
+
+type cachedCaller struct {
+	name    string
+	expires time.Time
+}
+
+// callerResolver resolves the hub user sending a request from its bearer token by a TokenReview
+// against the hub. The user-server does not authorize requests, the managed cluster does, the
+// caller is only used to share the proxy capacity between users. The results are cached by the
+// hash of the token, so that a TokenReview is not sent for every request.
+type callerResolver struct {
+	kubeClient kubernetes.Interface
+
+	lock  sync.Mutex
+	cache map[[sha256.Size]byte]cachedCaller
+}
+
+func newCallerResolver(kubeClient kubernetes.Interface) *callerResolver {
+	return &callerResolver{
+		kubeClient: kubeClient,
+		cache:      map[[sha256.Size]byte]cachedCaller{},
+	}
+}
+
+// caller returns the name of the user sending the request. The tokens the hub does not authenticate,
+// e.g. the serviceaccount tokens of the managed clusters, are identified by their hash, so that each
+// client gets its own share of the capacity rather than one shared by all of them.
+func (c *callerResolver) caller(req *http.Request) string {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return anonymousCaller
+	}
+
+	key := sha256.Sum256([]byte(token))
+	now := time.Now()
+
+	c.lock.Lock()
+	cached, ok := c.cache[key]
+	c.lock.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.name
+	}
+
+	name := tokenCaller(key)
+	tokenReview, err := c.kubeClient.AuthenticationV1().TokenReviews().Create(req.Context(), &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token: token,
+		},
+	}, metav1.CreateOptions{})
+	switch {
+	case err != nil:
+		// not cached, the token is reviewed again once the hub is back
+		klog.Errorf("failed to review the token of the caller: %v", err)
+		return name
+	case tokenReview.Status.Authenticated:
+		name = tokenReview.Status.User.Username
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.cache) >= maxCachedCallers {
+		c.prune(now)
+	}
+	if len(c.cache) < maxCachedCallers {
+		c.cache[key] = cachedCaller{name: name, expires: now.Add(callerTTL)}
+	}
+	return name
+}
+
+// tokenCaller returns the caller identified by the hash of its token.
+func tokenCaller(key [sha256.Size]byte) string {
+	return fmt.Sprintf("token:%x", key[:8])
+}
+
+// run removes the expired callers from the cache until the context is done.
+func (c *callerResolver) run(ctx context.Context) {
+	ticker := time.NewTicker(callerTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.lock.Lock()
+			c.prune(now)
+			c.lock.Unlock()
+		}
+	}
+}
+
+// prune removes the expired callers from the cache, the lock must be held.
+func (c *callerResolver) prune(now time.Time) {
+	for key, cached := range c.cache {
+		if now.After(cached.expires) {
+			delete(c.cache, key)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package userserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func TestCallerResolver(t *testing.T) {
+	reviews := 0
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reviews++
+		tokenReview := &authenticationv1.TokenReview{}
+		if err := json.NewDecoder(r.Body).Decode(tokenReview); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if tokenReview.Spec.Token == "hub-token" {
+			tokenReview.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "alice"}}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(tokenReview)
+	}))
+	defer hub.Close()
+	kubeClient, err := kubernetes.NewForConfig(&rest.Config{Host: hub.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := newCallerResolver(kubeClient)
+
+	caller := func(token string) string {
+		req := httptest.NewRequest(http.MethodGet, "/cluster1/api", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		return resolver.caller(req)
+	}
+
+	if actual := caller(""); actual != anonymousCaller {
+		t.Errorf("expected %s, got %s", anonymousCaller, actual)
+	}
+	if actual := caller("hub-token"); actual != "alice" {
+		t.Errorf("expected alice, got %s", actual)
+	}
+
+	// the tokens unknown to the hub are kept apart
+	managed1, managed2 := caller("managed-token-1"), caller("managed-token-2")
+	if managed1 == managed2 {
+		t.Errorf("expected the unknown tokens to be different callers, got %s for both", managed1)
+	}
+	if actual := caller("managed-token-1"); actual != managed1 {
+		t.Errorf("expected %s, got %s", managed1, actual)
+	}
+	if reviews != 3 {
+		t.Errorf("expected 3 token reviews, got %d", reviews)
+	}
+}
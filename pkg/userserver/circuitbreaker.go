@@ -0,0 +1,208 @@
+package userserver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+)
+
+// circuitBreakerIdleTimeout is how long the circuit breaker of a cluster without requests is kept.
+const circuitBreakerIdleTimeout = 10 * time.Minute
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitHalfOpen
+	circuitOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitClosed:
+		return "closed"
+	case circuitHalfOpen:
+		return "half-open"
+	case circuitOpen:
+		return "open"
+	}
+	return "unknown"
+}
+
+// circuitResult is the outcome of a request let through by a circuit breaker.
+type circuitResult int
+
+const (
+	// circuitSuccess means the service-proxy of the cluster was reached.
+	circuitSuccess circuitResult = iota
+	// circuitFailure means the tunnel or the service-proxy of the cluster could not be reached.
+	circuitFailure
+	// circuitIgnored means the request ended without telling anything about the cluster, e.g. the client went away.
+	circuitIgnored
+)
+
+type circuitBreakerOptions struct {
+	failureThreshold int
+	openDuration     time.Duration
+	halfOpenProbes   int
+}
+
+func newCircuitBreakerOptions() *circuitBreakerOptions {
+	return &circuitBreakerOptions{
+		failureThreshold: 5,
+		openDuration:     30 * time.Second,
+		halfOpenProbes:   1,
+	}
+}
+
+func (o *circuitBreakerOptions) addFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+
+	flags.IntVar(&o.failureThreshold, "circuit-breaker-failure-threshold", o.failureThreshold, "The number of consecutive failures to reach the service-proxy of a cluster that opens its circuit breaker, 0 disables the circuit breaker")
+	flags.DurationVar(&o.openDuration, "circuit-breaker-open-duration", o.openDuration, "How long the requests to a cluster fail fast once its circuit breaker is open, before probe requests are let through")
+	flags.IntVar(&o.halfOpenProbes, "circuit-breaker-half-open-probes", o.halfOpenProbes, "The number of probe requests let through concurrently to a cluster whose circuit breaker is half-open")
+}
+
+type circuitBreaker struct {
+	state    circuitState
+	failures int
+	openedAt time.Time
+	probes   int
+	lastSeen time.Time
+}
+
+// circuitBreakers holds a circuit breaker per cluster. The circuit breaker of a cluster opens after
+// consecutive failures to reach its service-proxy, e.g. when the proxy-agent is disconnected, and the
+// requests to the cluster fail fast instead of waiting for the tunnel dial to fail. Once the open
+// duration has elapsed the circuit breaker is half-open, probe requests are let through, and it is
+// closed by a successful probe or opened again by a failed one. The clusters come from the requests, so
+// circuit breakers are only created for the known clusters and removed once idle.
+type circuitBreakers struct {
+	options *circuitBreakerOptions
+	// known tells if the cluster is known, nil if all the clusters are
+	known func(cluster string) bool
+	now   func() time.Time
+
+	lock     sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func newCircuitBreakers(options *circuitBreakerOptions, known func(cluster string) bool) *circuitBreakers {
+	return &circuitBreakers{
+		options:  options,
+		known:    known,
+		now:      time.Now,
+		breakers: map[string]*circuitBreaker{},
+	}
+}
+
+// allow returns whether a request to the cluster is let through. If it is, the returned function must be
+// called once with the result of the request, otherwise the returned duration tells when to retry.
+func (c *circuitBreakers) allow(cluster string) (func(circuitResult), time.Duration, bool) {
+	if c.options.failureThreshold <= 0 {
+		return func(circuitResult) {}, 0, true
+	}
+	if c.known != nil && !c.known(cluster) {
+		// the tunnel to an unknown cluster fails anyway, not tracking it
+		return func(circuitResult) {}, 0, true
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	b, ok := c.breakers[cluster]
+	if !ok {
+		b = &circuitBreaker{}
+		c.breakers[cluster] = b
+	}
+	b.lastSeen = c.now()
+
+	probe := false
+	switch b.state {
+	case circuitOpen:
+		elapsed := c.now().Sub(b.openedAt)
+		if elapsed < c.options.openDuration {
+			return nil, c.options.openDuration - elapsed, false
+		}
+		c.setStateLocked(cluster, b, circuitHalfOpen)
+		fallthrough
+	case circuitHalfOpen:
+		if b.probes >= c.options.halfOpenProbes {
+			return nil, time.Second, false
+		}
+		b.probes++
+		probe = true
+	}
+
+	var once sync.Once
+	return func(result circuitResult) {
+		once.Do(func() {
+			c.report(cluster, b, probe, result)
+		})
+	}, 0, true
+}
+
+func (c *circuitBreakers) report(cluster string, b *circuitBreaker, probe bool, result circuitResult) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if probe {
+		b.probes--
+	}
+
+	switch result {
+	case circuitSuccess:
+		b.failures = 0
+		if b.state == circuitHalfOpen && probe {
+			c.setStateLocked(cluster, b, circuitClosed)
+		}
+	case circuitFailure:
+		b.failures++
+		if (b.state == circuitClosed && b.failures >= c.options.failureThreshold) || (b.state == circuitHalfOpen && probe) {
+			b.openedAt = c.now()
+			c.setStateLocked(cluster, b, circuitOpen)
+		}
+	}
+}
+
+func (c *circuitBreakers) setStateLocked(cluster string, b *circuitBreaker, state circuitState) {
+	klog.Infof("circuit breaker of cluster %s changed from %s to %s, consecutive failures: %d", cluster, b.state, state, b.failures)
+	b.state = state
+	circuitBreakerState.WithLabelValues(cluster).Set(float64(state))
+}
+
+// run removes the idle circuit breakers until the context is done.
+func (c *circuitBreakers) run(ctx context.Context) {
+	ticker := time.NewTicker(circuitBreakerIdleTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.prune()
+		}
+	}
+}
+
+// prune removes the circuit breakers without requests for circuitBreakerIdleTimeout, except the open ones
+// whose open duration has not elapsed and the ones with probes in flight.
+func (c *circuitBreakers) prune() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.now()
+	for cluster, b := range c.breakers {
+		if now.Sub(b.lastSeen) <= circuitBreakerIdleTimeout || b.probes > 0 {
+			continue
+		}
+		if b.state == circuitOpen && now.Sub(b.openedAt) < c.options.openDuration {
+			continue
+		}
+		delete(c.breakers, cluster)
+		circuitBreakerState.DeleteLabelValues(cluster)
+	}
+}
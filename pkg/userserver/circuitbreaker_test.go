@@ -0,0 +1,104 @@
+package userserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakers(t *testing.T) {
+	now := time.Now()
+	breakers := newCircuitBreakers(&circuitBreakerOptions{
+		failureThreshold: 2,
+		openDuration:     30 * time.Second,
+		halfOpenProbes:   1,
+	}, nil)
+	breakers.now = func() time.Time { return now }
+
+	send := func(cluster string, result circuitResult) bool {
+		report, _, ok := breakers.allow(cluster)
+		if ok {
+			report(result)
+		}
+		return ok
+	}
+
+	// consecutive failures open the circuit breaker
+	for i, result := range []circuitResult{circuitFailure, circuitSuccess, circuitFailure, circuitIgnored, circuitFailure} {
+		if !send("cluster1", result) {
+			t.Fatalf("expected request %d to be let through", i)
+		}
+	}
+	if _, retryAfter, ok := breakers.allow("cluster1"); ok || retryAfter != 30*time.Second {
+		t.Errorf("expected the circuit breaker to be open with retry after 30s, got %v, %v", ok, retryAfter)
+	}
+
+	// other clusters are not affected
+	if !send("cluster2", circuitSuccess) {
+		t.Errorf("expected the request to cluster2 to be let through")
+	}
+
+	// a single probe is let through once the open duration elapsed, a failed probe opens the circuit breaker again
+	now = now.Add(30 * time.Second)
+	report, _, ok := breakers.allow("cluster1")
+	if !ok {
+		t.Fatalf("expected the probe to be let through")
+	}
+	if _, _, ok := breakers.allow("cluster1"); ok {
+		t.Errorf("expected a single probe to be let through")
+	}
+	report(circuitFailure)
+	if _, _, ok := breakers.allow("cluster1"); ok {
+		t.Errorf("expected the circuit breaker to be open again")
+	}
+
+	// a successful probe closes the circuit breaker
+	now = now.Add(30 * time.Second)
+	if !send("cluster1", circuitSuccess) {
+		t.Fatalf("expected the probe to be let through")
+	}
+	if !send("cluster1", circuitFailure) {
+		t.Errorf("expected the circuit breaker to be closed")
+	}
+	if breakers.breakers["cluster1"].state != circuitClosed {
+		t.Errorf("expected the circuit breaker to stay closed after a single failure, got %s", breakers.breakers["cluster1"].state)
+	}
+}
+
+func TestCircuitBreakersKnownClusters(t *testing.T) {
+	now := time.Now()
+	breakers := newCircuitBreakers(&circuitBreakerOptions{
+		failureThreshold: 1,
+		openDuration:     30 * time.Second,
+		halfOpenProbes:   1,
+	}, func(cluster string) bool { return cluster != "unknown" })
+	breakers.now = func() time.Time { return now }
+
+	for _, cluster := range []string{"cluster1", "cluster2", "unknown"} {
+		report, _, ok := breakers.allow(cluster)
+		if !ok {
+			t.Fatalf("expected the request to %s to be let through", cluster)
+		}
+		report(circuitFailure)
+	}
+	// no circuit breaker is created for the unknown clusters
+	if _, ok := breakers.breakers["unknown"]; ok {
+		t.Errorf("expected no circuit breaker for the unknown cluster")
+	}
+	if _, _, ok := breakers.allow("unknown"); !ok {
+		t.Errorf("expected the requests to the unknown cluster to be let through")
+	}
+
+	// cluster2 keeps being requested, the circuit breaker of cluster1 is idle
+	now = now.Add(circuitBreakerIdleTimeout)
+	if _, _, ok := breakers.allow("cluster2"); !ok {
+		t.Errorf("expected the probe to cluster2 to be let through")
+	}
+	now = now.Add(time.Second)
+	breakers.prune()
+	if _, ok := breakers.breakers["cluster1"]; ok {
+		t.Errorf("expected the idle circuit breaker of cluster1 to be removed")
+	}
+	if _, ok := breakers.breakers["cluster2"]; !ok {
+		t.Errorf("expected the circuit breaker of cluster2 to be kept")
+	}
+}
@@ -0,0 +1,91 @@
+package userserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/stolostron/cluster-proxy-addon/pkg/utils"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// errMisdirectedRequest is returned when a request is sent on a connection opened for another cluster, e.g. when
+// a client coalesces the HTTP/2 connections of hosts covered by the same wildcard certificate.
+var errMisdirectedRequest = errors.New("the request is sent to a connection opened for another cluster")
+
+type clusterHostOptions struct {
+	// domain is the domain whose subdomains address the clusters, <cluster>.<domain>
+	domain    string
+	cert, key string
+}
+
+func (o *clusterHostOptions) addFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+
+	flags.StringVar(&o.domain, "cluster-host-domain", o.domain, "The domain whose subdomains address the clusters, e.g. proxy.hub.example.com. If set, the cluster of a request "+
+		"to <cluster>.<domain> is resolved from its host, and its whole path is the kube-apiserver or service path. The requests to other hosts still have the cluster as the first segment of their path")
+	flags.StringVar(&o.cert, "cluster-host-cert", o.cert, "The path to the certificate served for the subdomains of --cluster-host-domain, e.g. a wildcard certificate. The certificate of --server-cert is served if it is not set")
+	flags.StringVar(&o.key, "cluster-host-key", o.key, "The path to the key of --cluster-host-cert")
+}
+
+func (o *clusterHostOptions) enabled() bool {
+	return o.domain != ""
+}
+
+func (o *clusterHostOptions) validate() error {
+	if (o.cert == "") != (o.key == "") {
+		return fmt.Errorf("--cluster-host-cert and --cluster-host-key must be set together")
+	}
+	if o.cert != "" && o.domain == "" {
+		return fmt.Errorf("--cluster-host-domain is required with --cluster-host-cert")
+	}
+	if o.domain != "" {
+		if errs := validation.IsDNS1123Subdomain(strings.ToLower(o.domain)); len(errs) > 0 {
+			return fmt.Errorf("invalid --cluster-host-domain %q: %s", o.domain, strings.Join(errs, ", "))
+		}
+	}
+	return nil
+}
+
+// clusterHosts resolves the cluster of the requests to the subdomains of a domain.
+type clusterHosts struct {
+	domain string
+	// cert is served for the subdomains, nil if the serving certificate of the user-server covers them
+	cert *utils.CertificateReloader
+}
+
+// requestURI returns the request URI with the cluster as its first segment, the cluster of a request to
+// <cluster>.<domain> is prepended to its path.
+func (h *clusterHosts) requestURI(req *http.Request) (string, error) {
+	if h == nil {
+		return req.RequestURI, nil
+	}
+	cluster, ok, err := utils.GetClusterFromHost(req.Host, h.domain)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return req.RequestURI, nil
+	}
+
+	if req.TLS != nil && req.TLS.ServerName != "" {
+		if serverCluster, ok, _ := utils.GetClusterFromHost(req.TLS.ServerName, h.domain); ok && serverCluster != cluster {
+			return "", fmt.Errorf("%w: the host is %s, the server name is %s", errMisdirectedRequest, req.Host, req.TLS.ServerName)
+		}
+	}
+	return "/" + cluster + req.RequestURI, nil
+}
+
+// getCertificate returns the certificate of the subdomains to the clients connecting to one of them, and the
+// serving certificate to the others.
+func (k *userServer) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if k.clusterHosts != nil && k.clusterHosts.cert != nil {
+		if _, ok, _ := utils.GetClusterFromHost(hello.ServerName, k.clusterHosts.domain); ok {
+			return k.clusterHosts.cert.GetCertificate(hello)
+		}
+	}
+	return k.servingCert.GetCertificate(hello)
+}
@@ -0,0 +1,82 @@
+package userserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClusterHostsRequestURI(t *testing.T) {
+	testcases := []struct {
+		name       string
+		hosts      *clusterHosts
+		host       string
+		serverName string
+		uri        string
+		expect     string
+		expectErr  error
+	}{
+		{
+			name:   "disabled",
+			host:   "cluster1.proxy.hub.example.com",
+			uri:    "/cluster2/api/v1/pods",
+			expect: "/cluster2/api/v1/pods",
+		},
+		{
+			name:   "path prefix",
+			hosts:  &clusterHosts{domain: "proxy.hub.example.com"},
+			host:   "cluster-proxy-user.apps.hub.example.com",
+			uri:    "/cluster1/api/v1/pods?watch=true",
+			expect: "/cluster1/api/v1/pods?watch=true",
+		},
+		{
+			name:       "subdomain",
+			hosts:      &clusterHosts{domain: "proxy.hub.example.com"},
+			host:       "cluster1.proxy.hub.example.com",
+			serverName: "cluster1.proxy.hub.example.com",
+			uri:        "/api/v1/pods?watch=true",
+			expect:     "/cluster1/api/v1/pods?watch=true",
+		},
+		{
+			name:   "subdomain service",
+			hosts:  &clusterHosts{domain: "proxy.hub.example.com"},
+			host:   "cluster1.proxy.hub.example.com:443",
+			uri:    "/api/v1/namespaces/default/services/https:nginx:443/proxy-service/hello",
+			expect: "/cluster1/api/v1/namespaces/default/services/https:nginx:443/proxy-service/hello",
+		},
+		{
+			name:       "misdirected",
+			hosts:      &clusterHosts{domain: "proxy.hub.example.com"},
+			host:       "cluster1.proxy.hub.example.com",
+			serverName: "cluster2.proxy.hub.example.com",
+			uri:        "/api/v1/pods",
+			expectErr:  errMisdirectedRequest,
+		},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, c.uri, nil)
+			req.Host = c.host
+			if c.serverName != "" {
+				req.TLS = &tls.ConnectionState{ServerName: c.serverName}
+			}
+
+			actual, err := c.hosts.requestURI(req)
+			if c.expectErr != nil {
+				if !errors.Is(err, c.expectErr) {
+					t.Errorf("expected error %v, got %v", c.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if actual != c.expect {
+				t.Errorf("expected %s, got %s", c.expect, actual)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package userserver
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/cache"
+
+	clusterinformersv1 "open-cluster-management.io/api/client/cluster/informers/externalversions/cluster/v1"
+	clusterlisterv1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1"
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+// clusterReferenceIndex indexes the ManagedClusters by the values of their reference claims and labels.
+const clusterReferenceIndex = "clusterReference"
+
+var errAmbiguousClusterReference = errors.New("the cluster reference is ambiguous")
+
+type clusterReferenceOptions struct {
+	claims []string
+	labels []string
+}
+
+func (o *clusterReferenceOptions) addFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+
+	flags.StringSliceVar(&o.claims, "cluster-reference-claim", o.claims, "A ClusterClaim, e.g. id.k8s.io, whose value is accepted in place of the name of the cluster in the requests. It can be repeated")
+	flags.StringSliceVar(&o.labels, "cluster-reference-label", o.labels, "A label of the ManagedClusters whose value is accepted in place of the name of the cluster in the requests. It can be repeated")
+}
+
+func (o *clusterReferenceOptions) enabled() bool {
+	return len(o.claims) > 0 || len(o.labels) > 0
+}
+
+// clusterReferences resolves the references to the clusters, the values of their reference claims and labels,
+// to the names of the clusters.
+type clusterReferences struct {
+	lister  clusterlisterv1.ManagedClusterLister
+	indexer cache.Indexer
+}
+
+// newClusterReferences indexes the ManagedClusters of the informer, it must be called before the informer is started.
+func newClusterReferences(informer clusterinformersv1.ManagedClusterInformer, o *clusterReferenceOptions) (*clusterReferences, error) {
+	// the index function runs under the lock of the indexer, so the names of the clusters are tracked apart
+	// rather than listed from it.
+	names := &clusterNames{names: sets.New[string]()}
+	if _, err := informer.Informer().AddEventHandler(names); err != nil {
+		return nil, err
+	}
+	if err := informer.Informer().AddIndexers(cache.Indexers{
+		clusterReferenceIndex: clusterReferenceIndexFunc(o.claims, o.labels, names.has),
+	}); err != nil {
+		return nil, err
+	}
+	return &clusterReferences{
+		lister:  informer.Lister(),
+		indexer: informer.Informer().GetIndexer(),
+	}, nil
+}
+
+// clusterNames tracks the names of the ManagedClusters of an informer.
+type clusterNames struct {
+	mu    sync.RWMutex
+	names sets.Set[string]
+}
+
+func (n *clusterNames) has(name string) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.names.Has(name)
+}
+
+func (n *clusterNames) OnAdd(obj interface{}, _ bool) {
+	if cluster, ok := obj.(*clusterv1.ManagedCluster); ok {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.names.Insert(cluster.Name)
+	}
+}
+
+func (n *clusterNames) OnUpdate(_, _ interface{}) {}
+
+func (n *clusterNames) OnDelete(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if cluster, ok := obj.(*clusterv1.ManagedCluster); ok {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		n.names.Delete(cluster.Name)
+	}
+}
+
+// clusterReferenceIndexFunc indexes the values of the reference claims and labels of a cluster, except the values
+// equal to the name of a cluster, which a managed cluster could otherwise claim to capture its traffic.
+func clusterReferenceIndexFunc(claims, labels []string, isClusterName func(string) bool) cache.IndexFunc {
+	return func(obj interface{}) ([]string, error) {
+		cluster, ok := obj.(*clusterv1.ManagedCluster)
+		if !ok {
+			return nil, nil
+		}
+		references := sets.New[string]()
+		for _, claim := range cluster.Status.ClusterClaims {
+			if claim.Value != "" && slices.Contains(claims, claim.Name) {
+				references.Insert(claim.Value)
+			}
+		}
+		for _, label := range labels {
+			if value := cluster.Labels[label]; value != "" {
+				references.Insert(value)
+			}
+		}
+		for _, reference := range references.UnsortedList() {
+			if reference == cluster.Name || isClusterName(reference) {
+				references.Delete(reference)
+			}
+		}
+		return sets.List(references), nil
+	}
+}
+
+// resolve returns the name of the cluster the reference is the name, or the value of a reference claim or
+// label of. The name of a cluster always wins over the references, which the managed clusters can set, and an
+// unknown reference is returned as is. An error is returned if the reference is claimed by more than one
+// cluster rather than routing it to any of them.
+func (r *clusterReferences) resolve(reference string) (string, error) {
+	if r == nil {
+		return reference, nil
+	}
+
+	if _, err := r.lister.Get(reference); err == nil {
+		return reference, nil
+	}
+
+	clusters := sets.New[string]()
+	objs, err := r.indexer.ByIndex(clusterReferenceIndex, reference)
+	if err != nil {
+		return "", err
+	}
+	for _, obj := range objs {
+		if cluster, ok := obj.(*clusterv1.ManagedCluster); ok {
+			clusters.Insert(cluster.Name)
+		}
+	}
+
+	switch clusters.Len() {
+	case 0:
+		return reference, nil
+	case 1:
+		return clusters.UnsortedList()[0], nil
+	}
+	return "", fmt.Errorf("%w: %q is claimed by the clusters %v", errAmbiguousClusterReference, reference, sets.List(clusters))
+}
@@ -0,0 +1,172 @@
+package userserver
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/tools/cache"
+
+	clusterlisterv1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1"
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+func TestClusterReferencesResolve(t *testing.T) {
+	names := &clusterNames{names: sets.New[string]()}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{
+		clusterReferenceIndex: clusterReferenceIndexFunc([]string{"id.k8s.io"}, []string{"cmdb.example.com/id"}, names.has),
+	})
+	for _, cluster := range []*clusterv1.ManagedCluster{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster1", Labels: map[string]string{"cmdb.example.com/id": "ci-0001"}},
+			Status: clusterv1.ManagedClusterStatus{
+				ClusterClaims: []clusterv1.ManagedClusterClaim{
+					{Name: "id.k8s.io", Value: "0f6e4f7c-3c9a-4d3e-9a64-7d9b5f1e2a10"},
+					{Name: "platform.open-cluster-management.io", Value: "AWS"},
+				},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "123-cluster"},
+			Status: clusterv1.ManagedClusterStatus{
+				ClusterClaims: []clusterv1.ManagedClusterClaim{{Name: "id.k8s.io", Value: "cluster1"}},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster3", Labels: map[string]string{"cmdb.example.com/id": "ci-0003"}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster4", Labels: map[string]string{"cmdb.example.com/id": "ci-0003"}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster6", Labels: map[string]string{"cmdb.example.com/id": "cluster3"}},
+			Status: clusterv1.ManagedClusterStatus{
+				ClusterClaims: []clusterv1.ManagedClusterClaim{{Name: "id.k8s.io", Value: "cluster7"}},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster7"},
+		},
+	} {
+		if err := indexer.Add(cluster); err != nil {
+			t.Fatal(err)
+		}
+		names.OnAdd(cluster, true)
+	}
+	references := &clusterReferences{lister: clusterlisterv1.NewManagedClusterLister(indexer), indexer: indexer}
+
+	testcases := []struct {
+		name       string
+		references *clusterReferences
+		reference  string
+		expect     string
+		expectErr  error
+	}{
+		{
+			name:      "disabled",
+			reference: "ci-0001",
+			expect:    "ci-0001",
+		},
+		{
+			name:       "name",
+			references: references,
+			reference:  "123-cluster",
+			expect:     "123-cluster",
+		},
+		{
+			name:       "claim",
+			references: references,
+			reference:  "0f6e4f7c-3c9a-4d3e-9a64-7d9b5f1e2a10",
+			expect:     "cluster1",
+		},
+		{
+			name:       "label",
+			references: references,
+			reference:  "ci-0001",
+			expect:     "cluster1",
+		},
+		{
+			name:       "other claim",
+			references: references,
+			reference:  "AWS",
+			expect:     "AWS",
+		},
+		{
+			name:       "unknown",
+			references: references,
+			reference:  "cluster5",
+			expect:     "cluster5",
+		},
+		{
+			name:       "name and claim of another cluster",
+			references: references,
+			reference:  "cluster1",
+			expect:     "cluster1",
+		},
+		{
+			name:       "name and label of another cluster",
+			references: references,
+			reference:  "cluster3",
+			expect:     "cluster3",
+		},
+		{
+			name:       "name of a cluster added later and claim of another cluster",
+			references: references,
+			reference:  "cluster7",
+			expect:     "cluster7",
+		},
+		{
+			name:       "label of two clusters",
+			references: references,
+			reference:  "ci-0003",
+			expectErr:  errAmbiguousClusterReference,
+		},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.name, func(t *testing.T) {
+			actual, err := c.references.resolve(c.reference)
+			if c.expectErr != nil {
+				if !errors.Is(err, c.expectErr) {
+					t.Errorf("expected error %v, got %v", c.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if actual != c.expect {
+				t.Errorf("expected %s, got %s", c.expect, actual)
+			}
+		})
+	}
+}
+
+func TestClusterReferenceIndexFunc(t *testing.T) {
+	names := &clusterNames{names: sets.New[string]("cluster1", "cluster2")}
+	indexFunc := clusterReferenceIndexFunc([]string{"id.k8s.io"}, []string{"cmdb.example.com/id"}, names.has)
+
+	actual, err := indexFunc(&clusterv1.ManagedCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster3", Labels: map[string]string{"cmdb.example.com/id": "cluster2"}},
+		Status: clusterv1.ManagedClusterStatus{
+			ClusterClaims: []clusterv1.ManagedClusterClaim{
+				{Name: "id.k8s.io", Value: "cluster1"},
+				{Name: "id.k8s.io", Value: "cluster3"},
+				{Name: "id.k8s.io", Value: "0f6e4f7c-3c9a-4d3e-9a64-7d9b5f1e2a10"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if expect := []string{"0f6e4f7c-3c9a-4d3e-9a64-7d9b5f1e2a10"}; !slices.Equal(actual, expect) {
+		t.Errorf("expected %v, got %v", expect, actual)
+	}
+
+	names.OnDelete(&clusterv1.ManagedCluster{ObjectMeta: metav1.ObjectMeta{Name: "cluster1"}})
+	if names.has("cluster1") {
+		t.Errorf("expected cluster1 to be deleted")
+	}
+}
@@ -0,0 +1,237 @@
+package userserver
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	kubeinformers "k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+var errNoProxyServerEndpoint = errors.New("no ANP proxy-server endpoint is available")
+
+type proxyServerEndpointsOptions struct {
+	// service is the namespace/name of the Service of the ANP proxy-server
+	service string
+}
+
+func (o *proxyServerEndpointsOptions) addFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+
+	flags.StringVar(&o.service, "proxy-server-service", o.service, "The namespace/name of the Service of the ANP proxy-server. If set, the replicas of the proxy-server are discovered from the EndpointSlices of the Service and dialed individually, "+
+		"on the target port of the port of the Service set by --port, instead of dialing --host")
+}
+
+func (o *proxyServerEndpointsOptions) enabled() bool {
+	return o.service != ""
+}
+
+// proxyServerEndpoints holds the addresses of the ANP proxy-server replicas. A proxy-agent is not
+// necessarily connected to every replica, so the replica which served a cluster last is remembered
+// and tried first, and the other replicas are tried in turn when it fails.
+type proxyServerEndpoints struct {
+	lock      sync.Mutex
+	addresses []string
+	// affinity is the address of the replica which served each cluster last
+	affinity map[string]string
+	// next spreads the clusters without affinity across the replicas
+	next int
+}
+
+func newProxyServerEndpoints(addresses ...string) *proxyServerEndpoints {
+	e := &proxyServerEndpoints{affinity: map[string]string{}}
+	e.update(addresses)
+	return e
+}
+
+// update replaces the addresses of the replicas, the affinity to removed replicas is dropped.
+func (e *proxyServerEndpoints) update(addresses []string) {
+	sort.Strings(addresses)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	known := map[string]bool{}
+	for _, address := range addresses {
+		known[address] = true
+	}
+	for cluster, address := range e.affinity {
+		if !known[address] {
+			delete(e.affinity, cluster)
+		}
+	}
+	e.addresses = addresses
+	proxyServerEndpointsGauge.Set(float64(len(addresses)))
+}
+
+// candidates returns the addresses of the replicas in the order they are tried for the cluster.
+func (e *proxyServerEndpoints) candidates(cluster string) []string {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	candidates := make([]string, 0, len(e.addresses))
+	preferred, ok := e.affinity[cluster]
+	if ok {
+		candidates = append(candidates, preferred)
+	}
+
+	start := 0
+	if len(e.addresses) > 0 {
+		start = e.next % len(e.addresses)
+		e.next++
+	}
+	for i := range e.addresses {
+		address := e.addresses[(start+i)%len(e.addresses)]
+		if ok && address == preferred {
+			continue
+		}
+		candidates = append(candidates, address)
+	}
+	return candidates
+}
+
+// succeeded remembers the replica which served the cluster.
+func (e *proxyServerEndpoints) succeeded(cluster, address string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.affinity[cluster] = address
+}
+
+// failed forgets the replica which could not serve the cluster.
+func (e *proxyServerEndpoints) failed(cluster, address string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.affinity[cluster] == address {
+		delete(e.affinity, cluster)
+	}
+}
+
+// size returns the number of replicas.
+func (e *proxyServerEndpoints) size() int {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return len(e.addresses)
+}
+
+// watchServiceEndpoints calls onChange with the ready addresses serving the port of the Service in its
+// EndpointSlices, and again every time they change. The EndpointSlices hold the target port of the endpoints,
+// so the port of the Service is resolved to its name first. It returns once the Service and the EndpointSlices
+// are synced.
+func watchServiceEndpoints(stopCh <-chan struct{}, kubeClient kubernetes.Interface, namespace, service string, port int, onChange func(addresses []string)) error {
+	serviceInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(kubeClient, 10*time.Minute,
+		kubeinformers.WithNamespace(namespace),
+		kubeinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", service).String()
+		}),
+	)
+	serviceLister := serviceInformerFactory.Core().V1().Services().Lister()
+	sliceInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(kubeClient, 10*time.Minute,
+		kubeinformers.WithNamespace(namespace),
+		kubeinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = labels.Set{discoveryv1.LabelServiceName: service}.String()
+		}),
+	)
+	sliceLister := sliceInformerFactory.Discovery().V1().EndpointSlices().Lister()
+
+	resync := func() {
+		svc, err := serviceLister.Services(namespace).Get(service)
+		if err != nil {
+			klog.Errorf("failed to get the service %s/%s: %v", namespace, service, err)
+			onChange([]string{})
+			return
+		}
+		portName, ok := servicePortName(svc, int32(port))
+		if !ok {
+			klog.Errorf("the service %s/%s has no port %d", namespace, service, port)
+			onChange([]string{})
+			return
+		}
+		slices, err := sliceLister.EndpointSlices(namespace).List(labels.Everything())
+		if err != nil {
+			klog.Errorf("failed to list the EndpointSlices of the service %s/%s: %v", namespace, service, err)
+			return
+		}
+		addresses := readyAddresses(slices, portName)
+		klog.V(2).Infof("the endpoints of the service %s/%s are %v", namespace, service, addresses)
+		onChange(addresses)
+	}
+	handler := cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(interface{}) { resync() },
+		UpdateFunc: func(interface{}, interface{}) { resync() },
+		DeleteFunc: func(interface{}) { resync() },
+	}
+	if _, err := serviceInformerFactory.Core().V1().Services().Informer().AddEventHandler(handler); err != nil {
+		return err
+	}
+	if _, err := sliceInformerFactory.Discovery().V1().EndpointSlices().Informer().AddEventHandler(handler); err != nil {
+		return err
+	}
+
+	serviceInformerFactory.Start(stopCh)
+	sliceInformerFactory.Start(stopCh)
+	serviceInformerFactory.WaitForCacheSync(stopCh)
+	sliceInformerFactory.WaitForCacheSync(stopCh)
+	resync()
+	return nil
+}
+
+// servicePortName returns the name of the port of the Service, the EndpointSlices name their ports after it.
+func servicePortName(svc *corev1.Service, port int32) (string, bool) {
+	for _, p := range svc.Spec.Ports {
+		if p.Port == port {
+			return p.Name, true
+		}
+	}
+	return "", false
+}
+
+// readyAddresses returns the addresses of the ready endpoints, with the target port of the named Service port.
+func readyAddresses(slices []*discoveryv1.EndpointSlice, portName string) []string {
+	seen := map[string]bool{}
+	addresses := []string{}
+	for _, slice := range slices {
+		port, ok := endpointPort(slice, portName)
+		if !ok {
+			continue
+		}
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			for _, ip := range endpoint.Addresses {
+				address := net.JoinHostPort(ip, strconv.Itoa(int(port)))
+				if !seen[address] {
+					seen[address] = true
+					addresses = append(addresses, address)
+				}
+			}
+		}
+	}
+	return addresses
+}
+
+// endpointPort returns the number of the named port of the EndpointSlice.
+func endpointPort(slice *discoveryv1.EndpointSlice, portName string) (int32, bool) {
+	for _, p := range slice.Ports {
+		name := ""
+		if p.Name != nil {
+			name = *p.Name
+		}
+		if name == portName && p.Port != nil {
+			return *p.Port, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,98 @@
+package userserver
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/pointer"
+)
+
+func TestProxyServerEndpoints(t *testing.T) {
+	endpoints := newProxyServerEndpoints("10.0.0.2:8090", "10.0.0.1:8090", "10.0.0.3:8090")
+
+	// the clusters without affinity are spread across the replicas
+	first := endpoints.candidates("cluster1")
+	second := endpoints.candidates("cluster1")
+	if len(first) != 3 || first[0] == second[0] {
+		t.Errorf("expected the candidates to rotate, got %v and %v", first, second)
+	}
+
+	// the replica which served the cluster is tried first
+	endpoints.succeeded("cluster1", "10.0.0.3:8090")
+	for i := 0; i < 3; i++ {
+		candidates := endpoints.candidates("cluster1")
+		if len(candidates) != 3 || candidates[0] != "10.0.0.3:8090" {
+			t.Errorf("expected 10.0.0.3:8090 to be tried first, got %v", candidates)
+		}
+	}
+
+	// the affinity is dropped once the replica fails
+	endpoints.failed("cluster1", "10.0.0.3:8090")
+	if _, ok := endpoints.affinity["cluster1"]; ok {
+		t.Errorf("expected the affinity of cluster1 to be dropped")
+	}
+
+	// the affinity to a removed replica is dropped
+	endpoints.succeeded("cluster2", "10.0.0.2:8090")
+	endpoints.update([]string{"10.0.0.1:8090"})
+	if candidates := endpoints.candidates("cluster2"); !reflect.DeepEqual(candidates, []string{"10.0.0.1:8090"}) {
+		t.Errorf("expected only 10.0.0.1:8090, got %v", candidates)
+	}
+}
+
+func TestReadyAddresses(t *testing.T) {
+	slices := []*discoveryv1.EndpointSlice{
+		{
+			// the target ports differ from the ports of the Service
+			Ports: []discoveryv1.EndpointPort{{Name: pointer.String("proxy-server"), Port: pointer.Int32(8091)}, {Name: pointer.String("admin"), Port: pointer.Int32(8095)}},
+			Endpoints: []discoveryv1.Endpoint{
+				{Addresses: []string{"10.0.0.1"}, Conditions: discoveryv1.EndpointConditions{Ready: pointer.Bool(true)}},
+				{Addresses: []string{"10.0.0.2"}, Conditions: discoveryv1.EndpointConditions{Ready: pointer.Bool(false)}},
+				{Addresses: []string{"10.0.0.3"}},
+			},
+		},
+		{
+			// a slice of another port
+			Ports:     []discoveryv1.EndpointPort{{Name: pointer.String("https"), Port: pointer.Int32(8090)}},
+			Endpoints: []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.4"}}},
+		},
+		{
+			// the same endpoint in another slice
+			Ports:     []discoveryv1.EndpointPort{{Name: pointer.String("proxy-server"), Port: pointer.Int32(8091)}},
+			Endpoints: []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.1"}}},
+		},
+	}
+	svc := &corev1.Service{
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{
+				{Name: "proxy-server", Port: 8090, TargetPort: intstr.FromString("proxy")},
+				{Name: "admin", Port: 8095},
+			},
+		},
+	}
+
+	portName, ok := servicePortName(svc, 8090)
+	if !ok || portName != "proxy-server" {
+		t.Fatalf("expected the port proxy-server, got %q", portName)
+	}
+	if _, ok := servicePortName(svc, 443); ok {
+		t.Errorf("expected no port 443")
+	}
+
+	expected := []string{"10.0.0.1:8091", "10.0.0.3:8091"}
+	if actual := readyAddresses(slices, portName); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+
+	// the single port of a Service may not be named
+	unnamed := []*discoveryv1.EndpointSlice{{
+		Ports:     []discoveryv1.EndpointPort{{Port: pointer.Int32(8091)}},
+		Endpoints: []discoveryv1.Endpoint{{Addresses: []string{"10.0.0.1"}}},
+	}}
+	if actual := readyAddresses(unnamed, ""); !reflect.DeepEqual(actual, []string{"10.0.0.1:8091"}) {
+		t.Errorf("expected [10.0.0.1:8091], got %v", actual)
+	}
+}
@@ -0,0 +1,244 @@
+package userserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stolostron/cluster-proxy-addon/pkg/utils"
+)
+
+// requestClass is the class of a request, each class has its own concurrency pool so that
+// long-running streams and service traffic can not starve interactive kube API requests.
+type requestClass string
+
+const (
+	requestClassInteractive requestClass = "interactive"
+	requestClassLongRunning requestClass = "long-running"
+	requestClassService     requestClass = "service"
+)
+
+var (
+	errQueueFull    = errors.New("the queue is full")
+	errQueueTimeout = errors.New("timed out waiting in the queue")
+)
+
+type fairnessOptions struct {
+	interactiveConcurrency int
+	longRunningConcurrency int
+	serviceConcurrency     int
+	queueLength            int
+	queueTimeout           time.Duration
+}
+
+func newFairnessOptions() *fairnessOptions {
+	return &fairnessOptions{
+		queueLength:  128,
+		queueTimeout: 15 * time.Second,
+	}
+}
+
+func (o *fairnessOptions) addFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+
+	flags.IntVar(&o.interactiveConcurrency, "fairness-interactive-concurrency", o.interactiveConcurrency, "The maximum number of interactive kube API requests proxied concurrently, 0 means no limit")
+	flags.IntVar(&o.longRunningConcurrency, "fairness-long-running-concurrency", o.longRunningConcurrency, "The maximum number of long-running requests (watch, exec, attach, port-forward and log follow) proxied concurrently, 0 means no limit")
+	flags.IntVar(&o.serviceConcurrency, "fairness-service-concurrency", o.serviceConcurrency, "The maximum number of service-proxy requests proxied concurrently, 0 means no limit")
+	flags.IntVar(&o.queueLength, "fairness-queue-length", o.queueLength, "The maximum number of requests waiting for a seat in each concurrency pool")
+	flags.DurationVar(&o.queueTimeout, "fairness-queue-timeout", o.queueTimeout, "The maximum time a request waits for a seat before it is rejected")
+}
+
+func (o *fairnessOptions) enabled() bool {
+	return o.interactiveConcurrency > 0 || o.longRunningConcurrency > 0 || o.serviceConcurrency > 0
+}
+
+// classifyRequest returns the class of the request.
+func classifyRequest(req *http.Request, proxyType int) requestClass {
+	if proxyType == utils.ProxyTypeService {
+		return requestClassService
+	}
+
+	switch requestVerb(req) {
+	case "CONNECT", "WATCH":
+		return requestClassLongRunning
+	}
+	if strings.HasSuffix(req.URL.Path, "/log") {
+		if follow, _ := strconv.ParseBool(req.URL.Query().Get("follow")); follow {
+			return requestClassLongRunning
+		}
+	}
+	return requestClassInteractive
+}
+
+type waiter struct {
+	ready      chan struct{}
+	dispatched bool
+}
+
+// fairQueuingPool limits the number of requests executing concurrently. The requests waiting for
+// a seat are queued per user, and the queues are served round-robin, so that a user flooding the
+// pool only delays its own requests.
+type fairQueuingPool struct {
+	class        requestClass
+	concurrency  int
+	queueLength  int
+	queueTimeout time.Duration
+
+	lock      sync.Mutex
+	executing int
+	queued    int
+	queues    map[string][]*waiter
+	// users with queued requests, in the order they are served
+	users []string
+}
+
+func newFairQueuingPool(class requestClass, concurrency, queueLength int, queueTimeout time.Duration) *fairQueuingPool {
+	return &fairQueuingPool{
+		class:        class,
+		concurrency:  concurrency,
+		queueLength:  queueLength,
+		queueTimeout: queueTimeout,
+		queues:       map[string][]*waiter{},
+	}
+}
+
+// acquire waits for a seat for a request of the user. The returned function must be called to
+// release the seat once the request is done.
+func (p *fairQueuingPool) acquire(ctx context.Context, user string) (func(), error) {
+	if p.concurrency <= 0 {
+		return func() {}, nil
+	}
+
+	p.lock.Lock()
+	if p.executing < p.concurrency && p.queued == 0 {
+		p.executing++
+		p.recordLocked()
+		p.lock.Unlock()
+		return p.release, nil
+	}
+	if p.queued >= p.queueLength {
+		p.lock.Unlock()
+		return nil, errQueueFull
+	}
+
+	w := &waiter{ready: make(chan struct{})}
+	if _, ok := p.queues[user]; !ok {
+		p.users = append(p.users, user)
+	}
+	p.queues[user] = append(p.queues[user], w)
+	p.queued++
+	p.recordLocked()
+	p.lock.Unlock()
+
+	start := time.Now()
+	defer func() {
+		fairnessWaitDuration.WithLabelValues(string(p.class)).Observe(time.Since(start).Seconds())
+	}()
+
+	timer := time.NewTimer(p.queueTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		return p.release, nil
+	case <-timer.C:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	// the request may have been dispatched while timing out
+	if w.dispatched {
+		return p.release, nil
+	}
+	p.removeLocked(user, w)
+	p.recordLocked()
+	return nil, err
+}
+
+func (p *fairQueuingPool) release() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.executing--
+	p.dispatchLocked()
+	p.recordLocked()
+}
+
+// dispatchLocked gives the free seats to the queued requests, taking one request of each user in turn.
+func (p *fairQueuingPool) dispatchLocked() {
+	for p.executing < p.concurrency && p.queued > 0 {
+		user := p.users[0]
+		queue := p.queues[user]
+		w := queue[0]
+
+		if len(queue) == 1 {
+			delete(p.queues, user)
+			p.users = p.users[1:]
+		} else {
+			p.queues[user] = queue[1:]
+			// move the user to the end of the round
+			p.users = append(p.users[1:], user)
+		}
+		p.queued--
+
+		w.dispatched = true
+		close(w.ready)
+		p.executing++
+	}
+}
+
+func (p *fairQueuingPool) removeLocked(user string, w *waiter) {
+	queue := p.queues[user]
+	for i := range queue {
+		if queue[i] == w {
+			queue = append(queue[:i], queue[i+1:]...)
+			p.queued--
+			break
+		}
+	}
+	if len(queue) > 0 {
+		p.queues[user] = queue
+		return
+	}
+
+	delete(p.queues, user)
+	for i := range p.users {
+		if p.users[i] == user {
+			p.users = append(p.users[:i], p.users[i+1:]...)
+			break
+		}
+	}
+}
+
+func (p *fairQueuingPool) recordLocked() {
+	fairnessExecutingRequests.WithLabelValues(string(p.class)).Set(float64(p.executing))
+	fairnessQueuedRequests.WithLabelValues(string(p.class)).Set(float64(p.queued))
+}
+
+// fairness holds the concurrency pool of each request class.
+type fairness struct {
+	pools map[requestClass]*fairQueuingPool
+}
+
+func newFairness(o *fairnessOptions) *fairness {
+	return &fairness{
+		pools: map[requestClass]*fairQueuingPool{
+			requestClassInteractive: newFairQueuingPool(requestClassInteractive, o.interactiveConcurrency, o.queueLength, o.queueTimeout),
+			requestClassLongRunning: newFairQueuingPool(requestClassLongRunning, o.longRunningConcurrency, o.queueLength, o.queueTimeout),
+			requestClassService:     newFairQueuingPool(requestClassService, o.serviceConcurrency, o.queueLength, o.queueTimeout),
+		},
+	}
+}
+
+// acquire waits for a seat in the pool of the request class.
+func (f *fairness) acquire(ctx context.Context, class requestClass, user string) (func(), error) {
+	return f.pools[class].acquire(ctx, user)
+}
@@ -0,0 +1,135 @@
+package userserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stolostron/cluster-proxy-addon/pkg/utils"
+)
+
+func TestClassifyRequest(t *testing.T) {
+	testcases := []struct {
+		name      string
+		url       string
+		proxyType int
+		header    map[string]string
+		expect    requestClass
+	}{
+		{
+			name:      "list",
+			url:       "https://route-domain/cluster1/api/v1/pods",
+			proxyType: utils.ProxyTypeKubeAPIServer,
+			expect:    requestClassInteractive,
+		},
+		{
+			name:      "watch",
+			url:       "https://route-domain/cluster1/api/v1/pods?watch=1",
+			proxyType: utils.ProxyTypeKubeAPIServer,
+			expect:    requestClassLongRunning,
+		},
+		{
+			name:      "exec",
+			url:       "https://route-domain/cluster1/api/v1/namespaces/default/pods/nginx/exec",
+			proxyType: utils.ProxyTypeKubeAPIServer,
+			header:    map[string]string{"Connection": "Upgrade", "Upgrade": "SPDY/3.1"},
+			expect:    requestClassLongRunning,
+		},
+		{
+			name:      "log follow",
+			url:       "https://route-domain/cluster1/api/v1/namespaces/default/pods/nginx/log?follow=true",
+			proxyType: utils.ProxyTypeKubeAPIServer,
+			expect:    requestClassLongRunning,
+		},
+		{
+			name:      "log",
+			url:       "https://route-domain/cluster1/api/v1/namespaces/default/pods/nginx/log",
+			proxyType: utils.ProxyTypeKubeAPIServer,
+			expect:    requestClassInteractive,
+		},
+		{
+			name:      "service",
+			url:       "https://route-domain/cluster1/api/v1/namespaces/default/services/https:nginx:443/proxy-service/hello",
+			proxyType: utils.ProxyTypeService,
+			expect:    requestClassService,
+		},
+	}
+
+	for _, tc := range testcases {
+		req := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+		if actual := classifyRequest(req, tc.proxyType); actual != tc.expect {
+			t.Errorf("%s: expected class %q, got %q", tc.name, tc.expect, actual)
+		}
+	}
+}
+
+func TestFairQueuingPool(t *testing.T) {
+	pool := newFairQueuingPool(requestClassInteractive, 1, 3, time.Minute)
+
+	release, err := pool.acquire(context.Background(), "user1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// user1 floods the pool before user2 sends a request
+	dispatched := make(chan string, 3)
+	for i, user := range []string{"user1", "user1", "user2"} {
+		go func(user string) {
+			release, err := pool.acquire(context.Background(), user)
+			if err != nil {
+				dispatched <- err.Error()
+				return
+			}
+			dispatched <- user
+			release()
+		}(user)
+		waitForQueued(t, pool, i+1)
+	}
+
+	if _, err := pool.acquire(context.Background(), "user3"); err != errQueueFull {
+		t.Errorf("expected error %v, got %v", errQueueFull, err)
+	}
+
+	// the queues are served round-robin
+	release()
+	for _, expect := range []string{"user1", "user2", "user1"} {
+		if actual := <-dispatched; actual != expect {
+			t.Errorf("expected %s to be dispatched, got %s", expect, actual)
+		}
+	}
+}
+
+func TestFairQueuingPoolTimeout(t *testing.T) {
+	pool := newFairQueuingPool(requestClassService, 1, 1, 10*time.Millisecond)
+
+	release, err := pool.acquire(context.Background(), "user1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer release()
+
+	if _, err := pool.acquire(context.Background(), "user2"); err != errQueueTimeout {
+		t.Errorf("expected error %v, got %v", errQueueTimeout, err)
+	}
+	if pool.queued != 0 {
+		t.Errorf("expected the timed out request to leave the queue, got %d queued", pool.queued)
+	}
+}
+
+func waitForQueued(t *testing.T, pool *fairQueuingPool, queued int) {
+	for i := 0; i < 100; i++ {
+		pool.lock.Lock()
+		actual := pool.queued
+		pool.lock.Unlock()
+		if actual == queued {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d queued requests", queued)
+}
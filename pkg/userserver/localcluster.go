@@ -0,0 +1,133 @@
+package userserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stolostron/cluster-proxy-addon/pkg/constant"
+	"github.com/stolostron/cluster-proxy-addon/pkg/tracing"
+	"github.com/stolostron/cluster-proxy-addon/pkg/utils"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+
+	clusterclient "open-cluster-management.io/api/client/cluster/clientset/versioned"
+	clusterinformers "open-cluster-management.io/api/client/cluster/informers/externalversions"
+	clusterlisterv1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1"
+)
+
+type localClusterOptions struct {
+	// serviceProxyAddress is the host:port of the Service of the service-proxy running on the hub
+	serviceProxyAddress string
+	// claim is the name of the ClusterClaim set to true on the ManagedCluster of the hub, if any
+	claim string
+}
+
+func (o *localClusterOptions) addFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+
+	flags.StringVar(&o.serviceProxyAddress, "local-service-proxy-address", o.serviceProxyAddress, "The host:port of the Service of the service-proxy running on the hub, "+
+		"e.g. cluster-proxy-service-proxy.open-cluster-management-agent-addon.svc:7443. If set, the requests to the ManagedCluster of the hub, labeled "+constant.LabelLocalCluster+"=true, "+
+		"are sent to it directly instead of through the ANP tunnel")
+	flags.StringVar(&o.claim, "local-cluster-claim", o.claim, "The name of a ClusterClaim whose value is true on the ManagedCluster of the hub, which is then local "+
+		"even without the "+constant.LabelLocalCluster+" label. Requires --local-service-proxy-address")
+}
+
+func (o *localClusterOptions) validate() error {
+	if o.claim != "" && o.serviceProxyAddress == "" {
+		return fmt.Errorf("--local-cluster-claim requires --local-service-proxy-address")
+	}
+	return nil
+}
+
+func (o *localClusterOptions) enabled() bool {
+	return o.serviceProxyAddress != ""
+}
+
+// localClusters tells the ManagedCluster of the hub itself, whose service-proxy runs alongside the
+// user-server, so that its requests skip the round trip through the ANP proxy-server and proxy-agent.
+// The requests are still sent to the service-proxy, which authenticates and impersonates the users
+// as for any other cluster.
+type localClusters struct {
+	address string
+	claim   string
+	lister  clusterlisterv1.ManagedClusterLister
+	synced  cache.InformerSynced
+}
+
+func newLocalClusters(ctx context.Context, clusterClient clusterclient.Interface, o *localClusterOptions) *localClusters {
+	var informerOptions []clusterinformers.SharedInformerOption
+	if o.claim == "" {
+		// the claims are in the status, all the ManagedClusters are watched if they are looked up
+		informerOptions = append(informerOptions, clusterinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = labels.Set{constant.LabelLocalCluster: "true"}.String()
+		}))
+	}
+	informerFactory := clusterinformers.NewSharedInformerFactoryWithOptions(clusterClient, 30*time.Minute, informerOptions...)
+	informer := informerFactory.Cluster().V1().ManagedClusters()
+	l := &localClusters{
+		address: o.serviceProxyAddress,
+		claim:   o.claim,
+		lister:  informer.Lister(),
+		synced:  informer.Informer().HasSynced,
+	}
+	informerFactory.Start(ctx.Done())
+	return l
+}
+
+// isLocal returns whether the cluster is the hub itself, labeled local-cluster=true or with the claim set
+// to true. It is false until the ManagedClusters are
+// synced, the requests go through the ANP tunnel meanwhile.
+func (l *localClusters) isLocal(cluster string) bool {
+	if l == nil || !l.synced() {
+		return false
+	}
+	managedCluster, err := l.lister.Get(cluster)
+	if err != nil {
+		return false
+	}
+	if managedCluster.Labels[constant.LabelLocalCluster] == "true" {
+		return true
+	}
+	if l.claim == "" {
+		return false
+	}
+	for _, claim := range managedCluster.Status.ClusterClaims {
+		if claim.Name == l.claim {
+			return claim.Value == "true"
+		}
+	}
+	return false
+}
+
+// dialer returns a DialContext dialing the service-proxy of the hub, and retrying while the retry
+// budget allows it. The address dialed by the transport is ignored, the URL of the request keeps the
+// host of the service-proxy of the cluster, which is the server name verified in its certificate.
+func (l *localClusters) dialer(cluster, requestID string, timing *utils.ServerTiming, retries *retryBudget) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	return func(ctx context.Context, network, _ string) (net.Conn, error) {
+		for {
+			_, span := tracing.Start(ctx, "LocalDial")
+			start := time.Now()
+			conn, err := dialer.DialContext(ctx, network, l.address)
+			timing.Since("dial", "dial the local service-proxy", start)
+			tracing.End(span, err)
+			if err == nil {
+				localClusterRequests.WithLabelValues(cluster).Inc()
+				return conn, nil
+			}
+			if ctx.Err() != nil || !retries.wait(ctx) {
+				return nil, fmt.Errorf("failed to dial the local service-proxy %s: %v", l.address, err)
+			}
+			retriesTotal.WithLabelValues(cluster, retryPhaseDial).Inc()
+			klog.V(2).InfoS("retry to dial the local service-proxy", "requestID", requestID, "cluster", cluster, "err", err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package userserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stolostron/cluster-proxy-addon/pkg/constant"
+	"github.com/stolostron/cluster-proxy-addon/pkg/utils"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	clusterlisterv1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1"
+	clusterv1 "open-cluster-management.io/api/cluster/v1"
+)
+
+func TestLocalClustersIsLocal(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, cluster := range []*clusterv1.ManagedCluster{
+		{ObjectMeta: metav1.ObjectMeta{Name: "local-cluster", Labels: map[string]string{constant.LabelLocalCluster: "true"}}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "cluster1"}},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "hub"},
+			Status:     clusterv1.ManagedClusterStatus{ClusterClaims: []clusterv1.ManagedClusterClaim{{Name: "hub.example.com", Value: "true"}}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "cluster2"},
+			Status:     clusterv1.ManagedClusterStatus{ClusterClaims: []clusterv1.ManagedClusterClaim{{Name: "hub.example.com", Value: "false"}}},
+		},
+	} {
+		if err := indexer.Add(cluster); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lister := clusterlisterv1.NewManagedClusterLister(indexer)
+
+	testcases := []struct {
+		name    string
+		local   *localClusters
+		cluster string
+		expect  bool
+	}{
+		{
+			name:    "disabled",
+			cluster: "local-cluster",
+			expect:  false,
+		},
+		{
+			name:    "not synced",
+			local:   &localClusters{lister: lister, synced: func() bool { return false }},
+			cluster: "local-cluster",
+			expect:  false,
+		},
+		{
+			name:    "local cluster",
+			local:   &localClusters{lister: lister, synced: func() bool { return true }},
+			cluster: "local-cluster",
+			expect:  true,
+		},
+		{
+			name:    "managed cluster",
+			local:   &localClusters{lister: lister, synced: func() bool { return true }},
+			cluster: "cluster1",
+			expect:  false,
+		},
+		{
+			name:    "claim not honored",
+			local:   &localClusters{lister: lister, synced: func() bool { return true }},
+			cluster: "hub",
+			expect:  false,
+		},
+		{
+			name:    "claim",
+			local:   &localClusters{claim: "hub.example.com", lister: lister, synced: func() bool { return true }},
+			cluster: "hub",
+			expect:  true,
+		},
+		{
+			name:    "claim false",
+			local:   &localClusters{claim: "hub.example.com", lister: lister, synced: func() bool { return true }},
+			cluster: "cluster2",
+			expect:  false,
+		},
+		{
+			name:    "label with claim",
+			local:   &localClusters{claim: "hub.example.com", lister: lister, synced: func() bool { return true }},
+			cluster: "local-cluster",
+			expect:  true,
+		},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.name, func(t *testing.T) {
+			if actual := c.local.isLocal(c.cluster); actual != c.expect {
+				t.Errorf("expected %v, got %v", c.expect, actual)
+			}
+		})
+	}
+}
+
+func TestLocalClustersDialer(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	req := httptest.NewRequest(http.MethodGet, "/local-cluster/api/v1/pods", nil)
+	timing := utils.NewServerTimingFromRequest(req, "user-server")
+	retries := newRetryOptions().newRetryBudget(req, requestClassInteractive)
+
+	local := &localClusters{address: listener.Addr().String()}
+	// the address of the service-proxy of the cluster is not dialed
+	conn, err := local.dialer("local-cluster", "", timing, retries)(context.Background(), "tcp", "cluster-0123.open-cluster-management.proxy:7443")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer conn.Close()
+	if conn.RemoteAddr().String() != listener.Addr().String() {
+		t.Errorf("expected to dial %s, got %s", listener.Addr(), conn.RemoteAddr())
+	}
+}
@@ -0,0 +1,284 @@
+package userserver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/stolostron/cluster-proxy-addon/pkg/constant"
+	"github.com/stolostron/cluster-proxy-addon/pkg/utils"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+const (
+	metricsNamespace = "open_cluster_management_cluster_proxy_addon"
+	metricsSubsystem = "user_server"
+)
+
+// unknownClusterLabel is the cluster label of the metrics of the requests to clusters without the cluster-proxy addon,
+// the cluster comes from the request and is not trusted to create new series.
+const unknownClusterLabel = "unknown"
+
+// reasons of rejecting requests used in the rejectedRequests metric.
+const (
+	rejectReasonRateLimit      = "rate_limit"
+	rejectReasonQueueFull      = "queue_full"
+	rejectReasonQueueTimeout   = "queue_timeout"
+	rejectReasonCircuitOpen    = "circuit_open"
+	rejectReasonUnknownCluster = "unknown_cluster"
+)
+
+// retry phases used in the retriesTotal metric.
+const (
+	retryPhaseTunnel = "tunnel"
+	retryPhaseDial   = "dial"
+)
+
+// dial error reasons used in the tunnelDialErrors metric.
+const (
+	dialErrorReasonTunnel   = "tunnel"
+	dialErrorReasonTimeout  = "timeout"
+	dialErrorReasonCanceled = "canceled"
+	dialErrorReasonDial     = "dial"
+)
+
+var (
+	requestsTotal = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "requests_total",
+			Help:      "Number of requests handled by the user-server, labeled by target cluster, proxy type, verb and HTTP response code.",
+		},
+		[]string{"cluster", "proxy_type", "verb", "code"},
+	)
+
+	requestDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "request_duration_seconds",
+			Help:      "Latency of requests handled by the user-server, labeled by target cluster, proxy type, verb and HTTP response code.",
+			Buckets:   []float64{0.005, 0.025, 0.05, 0.1, 0.2, 0.4, 0.6, 0.8, 1.0, 1.25, 1.5, 2, 3, 4, 5, 6, 8, 10, 15, 20, 30, 45, 60},
+		},
+		[]string{"cluster", "proxy_type", "verb", "code"},
+	)
+
+	requestsInFlight = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "requests_in_flight",
+			Help:      "Number of requests currently being handled by the user-server, labeled by target cluster and proxy type.",
+		},
+		[]string{"cluster", "proxy_type"},
+	)
+
+	responseSizeBytes = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "response_size_bytes",
+			Help:      "Size of the response bodies returned by the user-server, labeled by target cluster, proxy type, verb and HTTP response code.",
+			Buckets:   metrics.ExponentialBuckets(256, 4, 10),
+		},
+		[]string{"cluster", "proxy_type", "verb", "code"},
+	)
+
+	tunnelDialDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "tunnel_dial_duration_seconds",
+			Help:      "Latency of dialing the service-proxy of a managed cluster through the ANP tunnel, labeled by target cluster.",
+			Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		},
+		[]string{"cluster"},
+	)
+
+	rejectedRequests = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "rejected_requests_total",
+			Help:      "Number of requests rejected by the user-server before being proxied, labeled by target cluster and reason.",
+		},
+		[]string{"cluster", "reason"},
+	)
+
+	fairnessExecutingRequests = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "fairness_executing_requests",
+			Help:      "Number of requests holding a seat in the concurrency pool of their class.",
+		},
+		[]string{"class"},
+	)
+
+	fairnessQueuedRequests = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "fairness_queued_requests",
+			Help:      "Number of requests waiting for a seat in the concurrency pool of their class.",
+		},
+		[]string{"class"},
+	)
+
+	fairnessWaitDuration = metrics.NewHistogramVec(
+		&metrics.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "fairness_wait_duration_seconds",
+			Help:      "Time requests waited in the queue for a seat in the concurrency pool of their class.",
+			Buckets:   []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 15, 30},
+		},
+		[]string{"class"},
+	)
+
+	circuitBreakerState = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "circuit_breaker_state",
+			Help:      "State of the circuit breaker of a cluster: 0 closed, 1 half-open, 2 open.",
+		},
+		[]string{"cluster"},
+	)
+
+	proxyServerEndpointsGauge = metrics.NewGauge(
+		&metrics.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "proxy_server_endpoints",
+			Help:      "Number of ANP proxy-server replicas dialed by the user-server.",
+		},
+	)
+
+	proxyServerFailovers = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "proxy_server_failovers_total",
+			Help:      "Number of times a request failed over to another ANP proxy-server replica, labeled by target cluster.",
+		},
+		[]string{"cluster"},
+	)
+
+	retriesTotal = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "retries_total",
+			Help:      "Number of retries of idempotent requests on dial failures, labeled by target cluster and phase (tunnel or dial).",
+		},
+		[]string{"cluster", "phase"},
+	)
+
+	localClusterRequests = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "local_cluster_requests_total",
+			Help:      "Number of requests to the cluster of the hub sent to its service-proxy directly, bypassing the ANP tunnel, labeled by target cluster.",
+		},
+		[]string{"cluster"},
+	)
+
+	tunnelDialErrors = metrics.NewCounterVec(
+		&metrics.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "tunnel_dial_errors_total",
+			Help:      "Number of failures to dial the service-proxy of a managed cluster through the ANP tunnel, labeled by target cluster and reason.",
+		},
+		[]string{"cluster", "reason"},
+	)
+)
+
+func init() {
+	legacyregistry.MustRegister(
+		requestsTotal,
+		requestDuration,
+		requestsInFlight,
+		responseSizeBytes,
+		rejectedRequests,
+		fairnessExecutingRequests,
+		fairnessQueuedRequests,
+		fairnessWaitDuration,
+		circuitBreakerState,
+		retriesTotal,
+		proxyServerEndpointsGauge,
+		proxyServerFailovers,
+		tunnelDialDuration,
+		tunnelDialErrors,
+		localClusterRequests,
+	)
+}
+
+// proxyTypeLabel converts the proxy type returned by utils.GetProxyType to a metric label value.
+func proxyTypeLabel(proxyType int) string {
+	switch proxyType {
+	case utils.ProxyTypeService:
+		return "service"
+	case utils.ProxyTypeKubeAPIServer:
+		return "kube-apiserver"
+	}
+	return "unknown"
+}
+
+// requestVerb returns a kube-apiserver like verb for the request, so that watch and
+// streaming (exec, attach, port-forward) requests can be told apart from plain gets.
+func requestVerb(req *http.Request) string {
+	if strings.EqualFold(req.Header.Get("Connection"), "upgrade") || req.Header.Get("Upgrade") != "" {
+		return "CONNECT"
+	}
+	if req.Method == http.MethodGet {
+		if watch, _ := strconv.ParseBool(req.URL.Query().Get("watch")); watch {
+			return "WATCH"
+		}
+	}
+	return strings.ToUpper(req.Method)
+}
+
+// dialErrorReason classifies errors returned when dialing through the tunnel.
+func dialErrorReason(err error) string {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return dialErrorReasonTimeout
+	case errors.Is(err, context.Canceled):
+		return dialErrorReasonCanceled
+	}
+	return dialErrorReasonDial
+}
+
+// recordRequest records the metrics of a finished request.
+func recordRequest(cluster, proxyType, verb string, rw *utils.ResponseRecorder, start time.Time) {
+	code := strconv.Itoa(rw.StatusCode())
+	requestsTotal.WithLabelValues(cluster, proxyType, verb, code).Inc()
+	requestDuration.WithLabelValues(cluster, proxyType, verb, code).Observe(time.Since(start).Seconds())
+	responseSizeBytes.WithLabelValues(cluster, proxyType, verb, code).Observe(float64(rw.Written()))
+}
+
+// clusterLabel returns the value of the cluster label of the metrics of the requests to the cluster: the cluster if
+// it is known, unknownClusterLabel otherwise.
+func (k *userServer) clusterLabel(cluster string) string {
+	if !k.knownCluster(cluster) {
+		return unknownClusterLabel
+	}
+	return cluster
+}
+
+// knownCluster tells if the cluster-proxy addon is installed on the cluster.
+func (k *userServer) knownCluster(cluster string) bool {
+	if cluster == "" || k.addonLister == nil {
+		return false
+	}
+	_, err := k.addonLister.ManagedClusterAddOns(cluster).Get(constant.AddonName)
+	return err == nil
+}
@@ -0,0 +1,85 @@
+package userserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stolostron/cluster-proxy-addon/pkg/constant"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+
+	addonv1alpha1 "open-cluster-management.io/api/addon/v1alpha1"
+	addonlisterv1alpha1 "open-cluster-management.io/api/client/addon/listers/addon/v1alpha1"
+)
+
+func TestRequestVerb(t *testing.T) {
+	testcases := []struct {
+		name   string
+		method string
+		url    string
+		header map[string]string
+		expect string
+	}{
+		{
+			name:   "get",
+			method: http.MethodGet,
+			url:    "https://route-domain/cluster1/api/v1/namespaces/default/pods/nginx",
+			expect: "GET",
+		},
+		{
+			name:   "watch",
+			method: http.MethodGet,
+			url:    "https://route-domain/cluster1/api/v1/namespaces/default/pods?watch=true",
+			expect: "WATCH",
+		},
+		{
+			name:   "exec",
+			method: http.MethodPost,
+			url:    "https://route-domain/cluster1/api/v1/namespaces/default/pods/nginx/exec?command=ls",
+			header: map[string]string{"Connection": "Upgrade", "Upgrade": "SPDY/3.1"},
+			expect: "CONNECT",
+		},
+		{
+			name:   "delete",
+			method: http.MethodDelete,
+			url:    "https://route-domain/cluster1/api/v1/namespaces/default/pods/nginx",
+			expect: "DELETE",
+		},
+	}
+
+	for _, tc := range testcases {
+		req := httptest.NewRequest(tc.method, tc.url, nil)
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+		if actual := requestVerb(req); actual != tc.expect {
+			t.Errorf("%s: expected verb %q, got %q", tc.name, tc.expect, actual)
+		}
+	}
+}
+
+func TestClusterLabel(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	if err := indexer.Add(&addonv1alpha1.ManagedClusterAddOn{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "cluster1", Name: constant.AddonName},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	k := &userServer{addonLister: addonlisterv1alpha1.NewManagedClusterAddOnLister(indexer)}
+
+	testcases := []struct {
+		cluster string
+		expect  string
+	}{
+		{cluster: "cluster1", expect: "cluster1"},
+		{cluster: "random-4f1c2a", expect: unknownClusterLabel},
+		{cluster: "", expect: unknownClusterLabel},
+	}
+
+	for _, tc := range testcases {
+		if actual := k.clusterLabel(tc.cluster); actual != tc.expect {
+			t.Errorf("expected label %q for cluster %q, got %q", tc.expect, tc.cluster, actual)
+		}
+	}
+}
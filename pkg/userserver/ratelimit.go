@@ -0,0 +1,197 @@
+package userserver
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stolostron/cluster-proxy-addon/pkg/constant"
+	"golang.org/x/time/rate"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// limiters not used for rateLimiterIdleTimeout are removed.
+	rateLimiterIdleTimeout = 10 * time.Minute
+)
+
+type rateLimitOptions struct {
+	clusterQPS   float64
+	clusterBurst int
+	userQPS      float64
+	userBurst    int
+}
+
+func (o *rateLimitOptions) addFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+
+	flags.Float64Var(&o.clusterQPS, "rate-limit-cluster-qps", o.clusterQPS, "The default number of requests per second admitted to a cluster, 0 disables the per-cluster rate limit. "+
+		"It can be overridden per cluster by the "+constant.AnnotationRateLimitQPS+" annotation on the cluster-proxy ManagedClusterAddOn")
+	flags.IntVar(&o.clusterBurst, "rate-limit-cluster-burst", o.clusterBurst, "The default burst of requests admitted to a cluster. "+
+		"It can be overridden per cluster by the "+constant.AnnotationRateLimitBurst+" annotation on the cluster-proxy ManagedClusterAddOn")
+	flags.Float64Var(&o.userQPS, "rate-limit-user-qps", o.userQPS, "The number of requests per second admitted from a user, 0 disables the per-user rate limit")
+	flags.IntVar(&o.userBurst, "rate-limit-user-burst", o.userBurst, "The burst of requests admitted from a user")
+}
+
+func (o *rateLimitOptions) userRateLimitEnabled() bool {
+	return o.userQPS > 0
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// rateLimiter admits requests by token buckets keyed by the target cluster and by the caller. The buckets
+// are local to the replica, a client keeps its connection to a replica so the limits are per replica.
+// A request takes a single token when it is admitted, whatever its duration, so long-running
+// requests (watch, exec, logs) count as one request and their bytes are not metered.
+type rateLimiter struct {
+	options *rateLimitOptions
+	// clusterLimit returns the limit overriding the default one for the cluster, if any.
+	clusterLimit func(cluster string) (qps float64, burst int, ok bool)
+	// known tells if the cluster exists, the cluster comes from the request and only the known ones have a limiter.
+	known func(cluster string) bool
+
+	lock            sync.Mutex
+	clusterLimiters map[string]*limiterEntry
+	userLimiters    map[string]*limiterEntry
+}
+
+func newRateLimiter(options *rateLimitOptions, clusterLimit func(cluster string) (float64, int, bool), known func(cluster string) bool) *rateLimiter {
+	return &rateLimiter{
+		options:         options,
+		clusterLimit:    clusterLimit,
+		known:           known,
+		clusterLimiters: map[string]*limiterEntry{},
+		userLimiters:    map[string]*limiterEntry{},
+	}
+}
+
+// admit takes a token from the bucket of the cluster, then from the bucket of the caller. The caller is
+// only resolved once the cluster admits the request, so that the requests rejected anyway are not
+// reviewed. If the request is not admitted, it returns how long the client should wait before retrying.
+// The requests to unknown clusters, which are rejected before their admission, are never admitted.
+func (r *rateLimiter) admit(cluster string, caller func() string, now time.Time) (string, bool, time.Duration) {
+	if r.known != nil && !r.known(cluster) {
+		return "", false, 0
+	}
+
+	clusterQPS, clusterBurst := r.options.clusterQPS, r.options.clusterBurst
+	if r.clusterLimit != nil {
+		if qps, burst, ok := r.clusterLimit(cluster); ok {
+			clusterQPS, clusterBurst = qps, burst
+		}
+	}
+
+	var clusterReservation *rate.Reservation
+	if clusterQPS > 0 {
+		r.lock.Lock()
+		clusterReservation = reserve(r.clusterLimiters, cluster, clusterQPS, clusterBurst, now)
+		r.lock.Unlock()
+		if retryAfter := reservationDelay(clusterReservation, now); retryAfter > 0 {
+			clusterReservation.CancelAt(now)
+			return "", false, retryAfter
+		}
+	}
+
+	user := caller()
+	if !r.options.userRateLimitEnabled() {
+		return user, true, 0
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	userReservation := reserve(r.userLimiters, user, r.options.userQPS, r.options.userBurst, now)
+	if retryAfter := reservationDelay(userReservation, now); retryAfter > 0 {
+		// give the tokens back, the request is rejected
+		userReservation.CancelAt(now)
+		if clusterReservation != nil {
+			clusterReservation.CancelAt(now)
+		}
+		return user, false, retryAfter
+	}
+	return user, true, 0
+}
+
+// reservationDelay returns how long the reservation has to wait for its token, 0 if it is available now.
+func reservationDelay(reservation *rate.Reservation, now time.Time) time.Duration {
+	if !reservation.OK() {
+		return math.MaxInt64
+	}
+	return reservation.DelayFrom(now)
+}
+
+func reserve(limiters map[string]*limiterEntry, key string, qps float64, burst int, now time.Time) *rate.Reservation {
+	if burst < 1 {
+		burst = 1
+	}
+	entry, ok := limiters[key]
+	if !ok {
+		entry = &limiterEntry{limiter: rate.NewLimiter(rate.Limit(qps), burst)}
+		limiters[key] = entry
+	}
+	if entry.limiter.Limit() != rate.Limit(qps) {
+		entry.limiter.SetLimitAt(now, rate.Limit(qps))
+	}
+	if entry.limiter.Burst() != burst {
+		entry.limiter.SetBurstAt(now, burst)
+	}
+	entry.lastSeen = now
+	return entry.limiter.ReserveN(now, 1)
+}
+
+// run removes the idle limiters until the context is done.
+func (r *rateLimiter) run(ctx context.Context) {
+	ticker := time.NewTicker(rateLimiterIdleTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.lock.Lock()
+			for _, limiters := range []map[string]*limiterEntry{r.clusterLimiters, r.userLimiters} {
+				for key, entry := range limiters {
+					if now.Sub(entry.lastSeen) > rateLimiterIdleTimeout {
+						delete(limiters, key)
+					}
+				}
+			}
+			r.lock.Unlock()
+		}
+	}
+}
+
+// retryAfterSeconds rounds the delay up to whole seconds, as required by the Retry-After header.
+func retryAfterSeconds(delay time.Duration) int {
+	if delay > time.Hour {
+		return int(time.Hour.Seconds())
+	}
+	return int(math.Ceil(delay.Seconds()))
+}
+
+// parseRateLimitAnnotations returns the rate limit set by the annotations, if any.
+func parseRateLimitAnnotations(annotations map[string]string, defaultBurst int) (float64, int, bool) {
+	qpsValue, ok := annotations[constant.AnnotationRateLimitQPS]
+	if !ok {
+		return 0, 0, false
+	}
+	qps, err := strconv.ParseFloat(qpsValue, 64)
+	if err != nil || qps < 0 {
+		klog.Warningf("invalid %s annotation %q", constant.AnnotationRateLimitQPS, qpsValue)
+		return 0, 0, false
+	}
+
+	burst := defaultBurst
+	if burstValue, ok := annotations[constant.AnnotationRateLimitBurst]; ok {
+		if burst, err = strconv.Atoi(burstValue); err != nil || burst < 1 {
+			klog.Warningf("invalid %s annotation %q", constant.AnnotationRateLimitBurst, burstValue)
+			burst = defaultBurst
+		}
+	}
+	return qps, burst, true
+}
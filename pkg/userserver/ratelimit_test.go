@@ -0,0 +1,154 @@
+package userserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stolostron/cluster-proxy-addon/pkg/constant"
+)
+
+// staticCaller returns a caller resolver of the user.
+func staticCaller(user string) func() string {
+	return func() string { return user }
+}
+
+func TestRateLimiterAdmit(t *testing.T) {
+	now := time.Now()
+	overrides := map[string]struct {
+		qps   float64
+		burst int
+	}{
+		"cluster2": {qps: 1, burst: 1},
+		"cluster3": {qps: 0},
+	}
+	limiter := newRateLimiter(
+		&rateLimitOptions{clusterQPS: 10, clusterBurst: 2, userQPS: 1, userBurst: 3},
+		func(cluster string) (float64, int, bool) {
+			o, ok := overrides[cluster]
+			return o.qps, o.burst, ok
+		},
+		nil,
+	)
+
+	testcases := []struct {
+		name    string
+		cluster string
+		user    string
+		admit   bool
+	}{
+		{name: "first request to cluster1", cluster: "cluster1", user: "user1", admit: true},
+		{name: "second request to cluster1", cluster: "cluster1", user: "user1", admit: true},
+		{name: "cluster1 burst exceeded", cluster: "cluster1", user: "user2", admit: false},
+		{name: "cluster2 overridden", cluster: "cluster2", user: "user2", admit: true},
+		{name: "cluster2 overridden burst exceeded", cluster: "cluster2", user: "user2", admit: false},
+		{name: "cluster3 not limited", cluster: "cluster3", user: "user1", admit: true},
+		{name: "user1 burst exceeded", cluster: "cluster3", user: "user1", admit: false},
+		{name: "user2 tokens given back by rejected requests", cluster: "cluster3", user: "user2", admit: true},
+	}
+
+	for _, tc := range testcases {
+		_, admitted, retryAfter := limiter.admit(tc.cluster, staticCaller(tc.user), now)
+		if admitted != tc.admit {
+			t.Errorf("%s: expected admitted %v, got %v", tc.name, tc.admit, admitted)
+		}
+		if !admitted && retryAfter <= 0 {
+			t.Errorf("%s: expected a positive retry after, got %v", tc.name, retryAfter)
+		}
+	}
+
+	// the buckets are refilled over time
+	if _, admitted, _ := limiter.admit("cluster1", staticCaller("user3"), now.Add(time.Second)); !admitted {
+		t.Errorf("expected the request to be admitted after the bucket is refilled")
+	}
+}
+
+func TestRateLimiterResolvesCallerOfAdmittedRequests(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter(&rateLimitOptions{clusterQPS: 1, clusterBurst: 1, userQPS: 1, userBurst: 1}, nil, nil)
+
+	resolved := 0
+	caller := func() string {
+		resolved++
+		return "user1"
+	}
+	for i, expect := range []bool{true, false} {
+		if _, admitted, _ := limiter.admit("cluster1", caller, now); admitted != expect {
+			t.Errorf("request %d: expected admitted %v, got %v", i, expect, admitted)
+		}
+	}
+	// the request rejected by the cluster limit is not reviewed
+	if resolved != 1 {
+		t.Errorf("expected the caller to be resolved once, got %d", resolved)
+	}
+
+	// the cluster token is given back when the user limit rejects the request
+	if _, admitted, _ := limiter.admit("cluster2", caller, now); admitted {
+		t.Errorf("expected the request to be rejected by the user limit")
+	}
+	if _, admitted, _ := limiter.admit("cluster2", staticCaller("user2"), now); !admitted {
+		t.Errorf("expected the cluster token to be given back")
+	}
+}
+
+func TestRateLimiterUnknownClusters(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter(&rateLimitOptions{clusterQPS: 1, clusterBurst: 1}, nil, func(cluster string) bool {
+		return cluster == "cluster1"
+	})
+
+	if _, admitted, _ := limiter.admit("cluster1", staticCaller("user1"), now); !admitted {
+		t.Errorf("expected the request to the known cluster to be admitted")
+	}
+	if _, admitted, _ := limiter.admit("cluster2", staticCaller("user1"), now); admitted {
+		t.Errorf("expected the request to the unknown cluster to be rejected")
+	}
+	if len(limiter.clusterLimiters) != 1 {
+		t.Errorf("expected 1 cluster limiter, got %d", len(limiter.clusterLimiters))
+	}
+}
+
+func TestParseRateLimitAnnotations(t *testing.T) {
+	testcases := []struct {
+		name        string
+		annotations map[string]string
+		qps         float64
+		burst       int
+		ok          bool
+	}{
+		{
+			name: "no annotations",
+		},
+		{
+			name:        "qps only",
+			annotations: map[string]string{constant.AnnotationRateLimitQPS: "2.5"},
+			qps:         2.5,
+			burst:       10,
+			ok:          true,
+		},
+		{
+			name:        "qps and burst",
+			annotations: map[string]string{constant.AnnotationRateLimitQPS: "5", constant.AnnotationRateLimitBurst: "20"},
+			qps:         5,
+			burst:       20,
+			ok:          true,
+		},
+		{
+			name:        "invalid qps",
+			annotations: map[string]string{constant.AnnotationRateLimitQPS: "fast"},
+		},
+		{
+			name:        "invalid burst",
+			annotations: map[string]string{constant.AnnotationRateLimitQPS: "5", constant.AnnotationRateLimitBurst: "-1"},
+			qps:         5,
+			burst:       10,
+			ok:          true,
+		},
+	}
+
+	for _, tc := range testcases {
+		qps, burst, ok := parseRateLimitAnnotations(tc.annotations, 10)
+		if qps != tc.qps || burst != tc.burst || ok != tc.ok {
+			t.Errorf("%s: expected (%v, %v, %v), got (%v, %v, %v)", tc.name, tc.qps, tc.burst, tc.ok, qps, burst, ok)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package userserver
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+type retryOptions struct {
+	maxRetries     int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+func newRetryOptions() *retryOptions {
+	return &retryOptions{
+		maxRetries:     2,
+		initialBackoff: 100 * time.Millisecond,
+		maxBackoff:     time.Second,
+	}
+}
+
+func (o *retryOptions) addFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+
+	flags.IntVar(&o.maxRetries, "dial-retries", o.maxRetries, "The maximum number of times an idempotent request is retried when the tunnel to the cluster can not be created or dialed, 0 disables the retries")
+	flags.DurationVar(&o.initialBackoff, "dial-retry-backoff", o.initialBackoff, "The time waited before the first retry, it is doubled after each retry")
+	flags.DurationVar(&o.maxBackoff, "dial-retry-max-backoff", o.maxBackoff, "The maximum time waited between two retries")
+}
+
+// retryBudget is the retries left to a request. Only the dial phase is retried: creating the tunnel and
+// dialing the service-proxy through it. Nothing has been sent to the cluster yet, so the request can be
+// retried safely. Once the connection is established the request is never retried.
+type retryBudget struct {
+	remaining int
+	backoff   wait.Backoff
+}
+
+// newRetryBudget returns the retry budget of the request, requests which can not be retried safely get none.
+func (o *retryOptions) newRetryBudget(req *http.Request, class requestClass) *retryBudget {
+	budget := &retryBudget{
+		backoff: wait.Backoff{
+			Duration: o.initialBackoff,
+			Factor:   2,
+			Jitter:   0.1,
+			Steps:    o.maxRetries,
+			Cap:      o.maxBackoff,
+		},
+	}
+	if isRetryable(req, class) {
+		budget.remaining = o.maxRetries
+	}
+	return budget
+}
+
+// isRetryable returns whether the request is idempotent, is not a stream, and has a body which can be replayed.
+func isRetryable(req *http.Request, class requestClass) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if class == requestClassLongRunning {
+		return false
+	}
+	return req.ContentLength == 0 || req.GetBody != nil
+}
+
+// wait waits for the backoff and takes a retry from the budget. It returns false if the budget is
+// exhausted or the context is done.
+func (b *retryBudget) wait(ctx context.Context) bool {
+	if b.remaining <= 0 || ctx.Err() != nil {
+		return false
+	}
+	b.remaining--
+
+	timer := time.NewTimer(b.backoff.Step())
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,80 @@
+package userserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	testcases := []struct {
+		name   string
+		method string
+		body   string
+		class  requestClass
+		expect bool
+	}{
+		{
+			name:   "get",
+			method: http.MethodGet,
+			class:  requestClassInteractive,
+			expect: true,
+		},
+		{
+			name:   "head",
+			method: http.MethodHead,
+			class:  requestClassService,
+			expect: true,
+		},
+		{
+			name:   "post",
+			method: http.MethodPost,
+			body:   "{}",
+			class:  requestClassInteractive,
+			expect: false,
+		},
+		{
+			name:   "watch",
+			method: http.MethodGet,
+			class:  requestClassLongRunning,
+			expect: false,
+		},
+	}
+
+	for _, tc := range testcases {
+		req := httptest.NewRequest(tc.method, "https://route-domain/cluster1/api/v1/pods", strings.NewReader(tc.body))
+		if actual := isRetryable(req, tc.class); actual != tc.expect {
+			t.Errorf("%s: expected %v, got %v", tc.name, tc.expect, actual)
+		}
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	o := &retryOptions{maxRetries: 2, initialBackoff: time.Millisecond, maxBackoff: time.Millisecond}
+
+	req := httptest.NewRequest(http.MethodGet, "https://route-domain/cluster1/api/v1/pods", nil)
+	budget := o.newRetryBudget(req, requestClassInteractive)
+	for i := 0; i < 2; i++ {
+		if !budget.wait(context.Background()) {
+			t.Errorf("expected retry %d to be allowed", i)
+		}
+	}
+	if budget.wait(context.Background()) {
+		t.Errorf("expected the retry budget to be exhausted")
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "https://route-domain/cluster1/api/v1/pods/nginx", nil)
+	if o.newRetryBudget(req, requestClassInteractive).wait(context.Background()) {
+		t.Errorf("expected a delete request not to be retried")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req = httptest.NewRequest(http.MethodGet, "https://route-domain/cluster1/api/v1/pods", nil)
+	if o.newRetryBudget(req, requestClassInteractive).wait(ctx) {
+		t.Errorf("expected no retry once the context is done")
+	}
+}
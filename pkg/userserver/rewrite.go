@@ -0,0 +1,235 @@
+package userserver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/stolostron/cluster-proxy-addon/pkg/utils"
+)
+
+const defaultResponseRewriteMaxBodySize = 10 << 20
+
+var (
+	// linkAttributePattern matches the root-relative links of the HTML attributes, href="/..." and the like,
+	// the protocol-relative links, //host/..., are not matched
+	linkAttributePattern = regexp.MustCompile(`(?i)(\s(?:href|src|action|formaction|poster)\s*=\s*["'])(/(?:[^/"'][^"']*)?)["']`)
+	// cssURLPattern matches the root-relative links of the CSS url() functions
+	cssURLPattern = regexp.MustCompile(`(?i)(url\(\s*["']?)(/(?:[^/)"'\s][^)"'\s]*)?)`)
+	// jsURLPattern matches the root-relative string literals of the JavaScript module specifiers, import "/..."
+	// and from "/...", of the dynamic imports and of the fetch() calls. The other links built by scripts can not be
+	// told apart from their other strings and are not rewritten
+	jsURLPattern = regexp.MustCompile("(\\b(?:from|import|fetch)\\s*\\(?\\s*[\"'`])(/(?:[^/\"'`][^\"'`]*)?)[\"'`]")
+
+	// rewritableContentTypes are the content types whose root-relative links are rewritten, by the patterns of
+	// their links, the HTML pages embed styles and scripts
+	rewritableContentTypes = map[string][]*regexp.Regexp{
+		"text/html":              {linkAttributePattern, cssURLPattern, jsURLPattern},
+		"text/css":               {cssURLPattern},
+		"text/javascript":        {jsURLPattern},
+		"application/javascript": {jsURLPattern},
+	}
+)
+
+type responseRewriteOptions struct {
+	// services are the namespace/name of the services whose responses are rewritten, * matches any namespace or name
+	services    []string
+	maxBodySize int64
+}
+
+func newResponseRewriteOptions() *responseRewriteOptions {
+	return &responseRewriteOptions{maxBodySize: defaultResponseRewriteMaxBodySize}
+}
+
+func (o *responseRewriteOptions) addFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+
+	flags.StringSliceVar(&o.services, "response-rewrite-service", o.services, "The namespace/name of a service, e.g. monitoring/grafana, whose responses through proxy-service are rewritten for "+
+		"the web UIs which are not aware of the path prefix they are served under: the Location header, the path of the cookies and the root-relative links of the HTML, the CSS "+
+		"and the module imports and fetch() calls of the JavaScript are prefixed with it, and the X-Forwarded-Prefix, X-Forwarded-Host and X-Forwarded-Proto headers are set on the requests. * matches any namespace or name. It can be repeated")
+	flags.Int64Var(&o.maxBodySize, "response-rewrite-max-body-size", o.maxBodySize, "The max size in bytes of the response bodies whose links are rewritten, the larger ones are sent as is")
+}
+
+func (o *responseRewriteOptions) validate() error {
+	for _, service := range o.services {
+		namespace, name, ok := strings.Cut(service, "/")
+		if !ok || namespace == "" || name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("invalid --response-rewrite-service %q, it must be namespace/name", service)
+		}
+	}
+	if o.maxBodySize <= 0 {
+		return fmt.Errorf("--response-rewrite-max-body-size must be positive")
+	}
+	return nil
+}
+
+// matches tells if the responses of the service are rewritten.
+func (o *responseRewriteOptions) matches(namespace, service string) bool {
+	for _, s := range o.services {
+		ns, name, _ := strings.Cut(s, "/")
+		if (ns == "*" || ns == namespace) && (name == "*" || name == service) {
+			return true
+		}
+	}
+	return false
+}
+
+// responseRewriter rewrites the responses of a service for the path prefix the service is served under, e.g.
+// /cluster1/api/v1/namespaces/monitoring/services/http:grafana:3000/proxy-service, so that the redirects,
+// cookies and links of its web UI, which assume it is served at the root, keep going through the proxy.
+type responseRewriter struct {
+	prefix string
+	// host is the host of the user-server the client sends the requests to
+	host        string
+	maxBodySize int64
+}
+
+type responseRewriterKey struct{}
+
+// newResponseRewriter returns the rewriter of the responses to the request, or nil if they are not rewritten.
+// requestURI is the request URI with the cluster as its first segment.
+func (o *responseRewriteOptions) newResponseRewriter(req *http.Request, requestURI string, tsc utils.TargetServiceConfig) *responseRewriter {
+	if !o.matches(tsc.Namespace, tsc.Service) {
+		return nil
+	}
+	prefix := utils.GetServicePathPrefix(requestURI)
+	// the cluster is not in the path of the requests to <cluster>.<domain>
+	prefix = strings.TrimPrefix(prefix, strings.TrimSuffix(requestURI, req.RequestURI))
+	return &responseRewriter{prefix: prefix, host: req.Host, maxBodySize: o.maxBodySize}
+}
+
+func withResponseRewriter(ctx context.Context, r *responseRewriter) context.Context {
+	return context.WithValue(ctx, responseRewriterKey{}, r)
+}
+
+func responseRewriterFrom(ctx context.Context) *responseRewriter {
+	r, _ := ctx.Value(responseRewriterKey{}).(*responseRewriter)
+	return r
+}
+
+// prepareRequest tells the service the prefix it is served under, for the apps which support it.
+func (r *responseRewriter) prepareRequest(req *http.Request) {
+	req.Header.Set(utils.HeaderForwardedPrefix, r.prefix)
+	req.Header.Set(utils.HeaderForwardedHost, r.host)
+	req.Header.Set(utils.HeaderForwardedProto, "https")
+	// the body is only rewritten if it is not compressed
+	req.Header.Del("Accept-Encoding")
+}
+
+// rewrite rewrites the Location header, the path of the cookies and the links of the body of the response.
+func (r *responseRewriter) rewrite(resp *http.Response) error {
+	if location := resp.Header.Get("Location"); location != "" {
+		resp.Header.Set("Location", r.rewriteLocation(location))
+	}
+	if cookies := resp.Header.Values("Set-Cookie"); len(cookies) > 0 {
+		resp.Header.Del("Set-Cookie")
+		for _, cookie := range cookies {
+			resp.Header.Add("Set-Cookie", r.rewriteCookie(cookie))
+		}
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols || resp.Body == nil || resp.Body == http.NoBody {
+		return nil
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+	patterns, ok := rewritableContentTypes[mediaType]
+	if !ok {
+		return nil
+	}
+	if resp.ContentLength > r.maxBodySize {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, r.maxBodySize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > r.maxBodySize {
+		// too large to be rewritten, the part already read is sent as is with the rest
+		resp.Body = &multiReadCloser{Reader: io.MultiReader(bytes.NewReader(body), resp.Body), Closer: resp.Body}
+		return nil
+	}
+	_ = resp.Body.Close()
+
+	body = r.rewriteLinks(body, patterns)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// rewriteLocation prefixes the root-relative locations and the absolute ones to the host of the request.
+func (r *responseRewriter) rewriteLocation(location string) string {
+	u, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	switch {
+	case u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/"):
+	case u.Host != "" && strings.EqualFold(u.Host, r.host):
+	default:
+		return location
+	}
+	if r.prefixed(u.Path) {
+		return location
+	}
+	u.Path = r.prefix + u.Path
+	u.RawPath = ""
+	return u.String()
+}
+
+// rewriteCookie prefixes the path of the cookie, the cookies without path default to the path of the request
+// which is already under the prefix.
+func (r *responseRewriter) rewriteCookie(cookie string) string {
+	attributes := strings.Split(cookie, ";")
+	for i, attribute := range attributes {
+		name, value, ok := strings.Cut(strings.TrimSpace(attribute), "=")
+		if !ok || !strings.EqualFold(name, "path") || !strings.HasPrefix(value, "/") || r.prefixed(value) {
+			continue
+		}
+		attributes[i] = " " + name + "=" + r.prefix + value
+	}
+	return strings.Join(attributes, ";")
+}
+
+// rewriteLinks prefixes the root-relative links matched by the patterns, whose second group is the link.
+func (r *responseRewriter) rewriteLinks(body []byte, patterns []*regexp.Regexp) []byte {
+	for _, pattern := range patterns {
+		body = pattern.ReplaceAllFunc(body, func(match []byte) []byte {
+			groups := pattern.FindSubmatchIndex(match)
+			link := string(match[groups[4]:groups[5]])
+			if r.prefixed(link) {
+				return match
+			}
+			rewritten := make([]byte, 0, len(match)+len(r.prefix))
+			rewritten = append(rewritten, match[:groups[4]]...)
+			rewritten = append(rewritten, r.prefix...)
+			return append(rewritten, match[groups[4]:]...)
+		})
+	}
+	return body
+}
+
+// prefixed tells if the path is already under the prefix, e.g. the app supports X-Forwarded-Prefix.
+func (r *responseRewriter) prefixed(path string) bool {
+	return path == r.prefix || strings.HasPrefix(path, r.prefix+"/") || strings.HasPrefix(path, r.prefix+"?")
+}
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
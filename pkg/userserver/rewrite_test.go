@@ -0,0 +1,225 @@
+package userserver
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stolostron/cluster-proxy-addon/pkg/utils"
+)
+
+const grafanaPrefix = "/cluster1/api/v1/namespaces/monitoring/services/http:grafana:3000/proxy-service"
+
+func TestNewResponseRewriter(t *testing.T) {
+	options := &responseRewriteOptions{services: []string{"monitoring/grafana", "*/dashboard"}, maxBodySize: defaultResponseRewriteMaxBodySize}
+
+	testcases := []struct {
+		name       string
+		host       string
+		uri        string
+		requestURI string
+		tsc        utils.TargetServiceConfig
+		expect     string
+	}{
+		{
+			name:   "path prefix",
+			host:   "cluster-proxy-user.apps.hub.example.com",
+			uri:    grafanaPrefix + "/d/home?orgId=1",
+			tsc:    utils.TargetServiceConfig{Namespace: "monitoring", Service: "grafana"},
+			expect: grafanaPrefix,
+		},
+		{
+			name:       "subdomain",
+			host:       "cluster1.proxy.hub.example.com",
+			uri:        "/api/v1/namespaces/monitoring/services/http:grafana:3000/proxy-service/d/home",
+			requestURI: grafanaPrefix + "/d/home",
+			tsc:        utils.TargetServiceConfig{Namespace: "monitoring", Service: "grafana"},
+			expect:     "/api/v1/namespaces/monitoring/services/http:grafana:3000/proxy-service",
+		},
+		{
+			name:   "any namespace",
+			host:   "cluster-proxy-user.apps.hub.example.com",
+			uri:    "/cluster1/api/v1/namespaces/kube-system/services/dashboard/proxy-service/",
+			tsc:    utils.TargetServiceConfig{Namespace: "kube-system", Service: "dashboard"},
+			expect: "/cluster1/api/v1/namespaces/kube-system/services/dashboard/proxy-service",
+		},
+		{
+			name: "not matched",
+			host: "cluster-proxy-user.apps.hub.example.com",
+			uri:  "/cluster1/api/v1/namespaces/default/services/grafana/proxy-service/",
+			tsc:  utils.TargetServiceConfig{Namespace: "default", Service: "grafana"},
+		},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, c.uri, nil)
+			req.Host = c.host
+			requestURI := c.requestURI
+			if requestURI == "" {
+				requestURI = c.uri
+			}
+
+			rewriter := options.newResponseRewriter(req, requestURI, c.tsc)
+			if c.expect == "" {
+				if rewriter != nil {
+					t.Errorf("expected no rewriter, got prefix %s", rewriter.prefix)
+				}
+				return
+			}
+			if rewriter == nil {
+				t.Fatalf("expected prefix %s, got no rewriter", c.expect)
+			}
+			if rewriter.prefix != c.expect {
+				t.Errorf("expected prefix %s, got %s", c.expect, rewriter.prefix)
+			}
+		})
+	}
+}
+
+func TestResponseRewriterLocation(t *testing.T) {
+	rewriter := &responseRewriter{prefix: grafanaPrefix, host: "proxy.example.com"}
+
+	testcases := []struct {
+		location string
+		expect   string
+	}{
+		{location: "/login", expect: grafanaPrefix + "/login"},
+		{location: "/login?redirect=%2Fd%2Fhome", expect: grafanaPrefix + "/login?redirect=%2Fd%2Fhome"},
+		{location: "https://proxy.example.com/login", expect: "https://proxy.example.com" + grafanaPrefix + "/login"},
+		{location: grafanaPrefix + "/login", expect: grafanaPrefix + "/login"},
+		{location: "login", expect: "login"},
+		{location: "//sso.example.com/login", expect: "//sso.example.com/login"},
+		{location: "https://sso.example.com/login", expect: "https://sso.example.com/login"},
+	}
+
+	for _, c := range testcases {
+		if actual := rewriter.rewriteLocation(c.location); actual != c.expect {
+			t.Errorf("expected %s, got %s", c.expect, actual)
+		}
+	}
+}
+
+func TestResponseRewriterCookie(t *testing.T) {
+	rewriter := &responseRewriter{prefix: grafanaPrefix}
+
+	testcases := []struct {
+		cookie string
+		expect string
+	}{
+		{cookie: "grafana_session=abc; Path=/; HttpOnly", expect: "grafana_session=abc; Path=" + grafanaPrefix + "/; HttpOnly"},
+		{cookie: "a=b; path=/api", expect: "a=b; path=" + grafanaPrefix + "/api"},
+		{cookie: "a=b; Path=" + grafanaPrefix, expect: "a=b; Path=" + grafanaPrefix},
+		{cookie: "a=b; HttpOnly", expect: "a=b; HttpOnly"},
+	}
+
+	for _, c := range testcases {
+		if actual := rewriter.rewriteCookie(c.cookie); actual != c.expect {
+			t.Errorf("expected %s, got %s", c.expect, actual)
+		}
+	}
+}
+
+func TestResponseRewriterBody(t *testing.T) {
+	testcases := []struct {
+		name        string
+		contentType string
+		encoding    string
+		body        string
+		maxBodySize int64
+		expect      string
+	}{
+		{
+			name:        "html",
+			contentType: "text/html; charset=utf-8",
+			body:        `<a href="/d/home">home</a><script src='/public/app.js'></script><a href="//cdn.example.com/x">cdn</a><a href="d/home">relative</a>`,
+			expect:      `<a href="` + grafanaPrefix + `/d/home">home</a><script src='` + grafanaPrefix + `/public/app.js'></script><a href="//cdn.example.com/x">cdn</a><a href="d/home">relative</a>`,
+		},
+		{
+			name:        "already prefixed",
+			contentType: "text/html",
+			body:        `<a href="` + grafanaPrefix + `/d/home">home</a><form action="/">`,
+			expect:      `<a href="` + grafanaPrefix + `/d/home">home</a><form action="` + grafanaPrefix + `/">`,
+		},
+		{
+			name:        "css",
+			contentType: "text/css",
+			body:        `body { background: url(/public/bg.png) } @font-face { src: url("/fonts/a.woff") }`,
+			expect:      `body { background: url(` + grafanaPrefix + `/public/bg.png) } @font-face { src: url("` + grafanaPrefix + `/fonts/a.woff") }`,
+		},
+		{
+			name:        "json",
+			contentType: "application/json",
+			body:        `{"href": "/d/home"}`,
+			expect:      `{"href": "/d/home"}`,
+		},
+		{
+			name:        "javascript",
+			contentType: "text/javascript",
+			body:        `import { a } from "/public/a.js"; import '/public/b.js'; const c = await import("/public/c.js"); fetch(` + "`/api/search?q=${q}`" + `)`,
+			expect: `import { a } from "` + grafanaPrefix + `/public/a.js"; import '` + grafanaPrefix + `/public/b.js'; const c = await import("` + grafanaPrefix + `/public/c.js"); ` +
+				"fetch(`" + grafanaPrefix + "/api/search?q=${q}`)",
+		},
+		{
+			name:        "javascript other strings",
+			contentType: "application/javascript",
+			body:        `el.innerHTML = '<a href="/d/home">home</a>'; const api = "/api"; fetch("//cdn.example.com/x"); fetch(api + "/search")`,
+			expect:      `el.innerHTML = '<a href="/d/home">home</a>'; const api = "/api"; fetch("//cdn.example.com/x"); fetch(api + "/search")`,
+		},
+		{
+			name:        "html inline script",
+			contentType: "text/html",
+			body:        `<script type="module">import { boot } from "/public/boot.js"; fetch("/api/frontend/settings")</script>`,
+			expect:      `<script type="module">import { boot } from "` + grafanaPrefix + `/public/boot.js"; fetch("` + grafanaPrefix + `/api/frontend/settings")</script>`,
+		},
+		{
+			name:        "compressed",
+			contentType: "text/html",
+			encoding:    "gzip",
+			body:        `<a href="/d/home">`,
+			expect:      `<a href="/d/home">`,
+		},
+		{
+			name:        "too large",
+			contentType: "text/html",
+			body:        `<a href="/d/home">home</a>`,
+			maxBodySize: 8,
+			expect:      `<a href="/d/home">home</a>`,
+		},
+	}
+
+	for _, c := range testcases {
+		t.Run(c.name, func(t *testing.T) {
+			maxBodySize := c.maxBodySize
+			if maxBodySize == 0 {
+				maxBodySize = defaultResponseRewriteMaxBodySize
+			}
+			rewriter := &responseRewriter{prefix: grafanaPrefix, maxBodySize: maxBodySize}
+			resp := &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{"Content-Type": []string{c.contentType}},
+				Body:          io.NopCloser(strings.NewReader(c.body)),
+				ContentLength: -1,
+			}
+			if c.encoding != "" {
+				resp.Header.Set("Content-Encoding", c.encoding)
+			}
+
+			if err := rewriter.rewrite(resp); err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			actual, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(actual) != c.expect {
+				t.Errorf("expected %s, got %s", c.expect, actual)
+			}
+			if c.expect != c.body && resp.ContentLength != int64(len(actual)) {
+				t.Errorf("expected content length %d, got %d", len(actual), resp.ContentLength)
+			}
+		})
+	}
+}
@@ -2,33 +2,41 @@ package userserver
 
 import (
 	"context"
-	"crypto/sha256"
 	"crypto/tls"
-	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"os"
 	"strconv"
 	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/stolostron/cluster-proxy-addon/pkg/constant"
+	"github.com/stolostron/cluster-proxy-addon/pkg/tracing"
 	"github.com/stolostron/cluster-proxy-addon/pkg/utils"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
 	grpccredentials "google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
-	addonutils "open-cluster-management.io/addon-framework/pkg/utils"
 	konnectivity "sigs.k8s.io/apiserver-network-proxy/konnectivity-client/pkg/client"
-	"sigs.k8s.io/apiserver-network-proxy/pkg/util"
 
 	addonclient "open-cluster-management.io/api/client/addon/clientset/versioned"
 	addoninformers "open-cluster-management.io/api/client/addon/informers/externalversions"
 	addonlisterv1alpha1 "open-cluster-management.io/api/client/addon/listers/addon/v1alpha1"
+	clusterclient "open-cluster-management.io/api/client/cluster/clientset/versioned"
+	clusterinformers "open-cluster-management.io/api/client/cluster/informers/externalversions"
+	clusterlisterv1 "open-cluster-management.io/api/client/cluster/listers/cluster/v1"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 )
 
 func NewUserServerCommand() *cobra.Command {
@@ -39,7 +47,7 @@ func NewUserServerCommand() *cobra.Command {
 		Short: "user-server",
 		Long:  `A http proxy server, receives http requests from users and forwards to the ANP proxy-server.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return userServer.Run(cmd.Context())
+			return userServer.Run(ctrl.SetupSignalHandler())
 		},
 	}
 
@@ -47,25 +55,58 @@ func NewUserServerCommand() *cobra.Command {
 	return cmd
 }
 
-var (
-	serviceProxyRootCA *x509.CertPool
-)
-
 type userServer struct {
 	// TODO: make it a controller and reuse tunnel for each cluster to improve performance.
-	getTunnel       func(context.Context) (konnectivity.Tunnel, error)
+	getTunnel       func(ctx context.Context, address string) (konnectivity.Tunnel, error)
 	proxyServerHost string
 	proxyServerPort int
 
+	proxyServerEndpointsOptions *proxyServerEndpointsOptions
+	proxyServers                *proxyServerEndpoints
+
 	proxyCACertPath, proxyCertPath, proxyKeyPath string
 
 	serverCert, serverKey string
 	serverPort            int
 
+	shutdownOptions *utils.ShutdownOptions
+	drainer         *utils.Drainer
+
 	serviceProxyCACertPath string
+	serviceProxyCA         *utils.CAReloader
+	servingCert            *utils.CertificateReloader
 	agentInstallNamespace  string
 
 	addonLister addonlisterv1alpha1.ManagedClusterAddOnLister
+	addonSynced cache.InformerSynced
+
+	tracingOptions *tracing.Options
+
+	rateLimitOptions *rateLimitOptions
+	rateLimiter      *rateLimiter
+	callerResolver   *callerResolver
+
+	fairnessOptions *fairnessOptions
+	fairness        *fairness
+
+	circuitBreakerOptions *circuitBreakerOptions
+	circuitBreakers       *circuitBreakers
+
+	retryOptions *retryOptions
+
+	localClusterOptions *localClusterOptions
+	localClusters       *localClusters
+
+	agentIdentifierOptions *agentIdentifierOptions
+	agentIdentifiers       *agentIdentifiers
+
+	clusterHostOptions *clusterHostOptions
+	clusterHosts       *clusterHosts
+
+	clusterReferenceOptions *clusterReferenceOptions
+	clusterReferences       *clusterReferences
+
+	responseRewriteOptions *responseRewriteOptions
 }
 
 func (k *userServer) AddFlags(cmd *cobra.Command) {
@@ -82,9 +123,23 @@ func (k *userServer) AddFlags(cmd *cobra.Command) {
 	flags.StringVar(&k.serverKey, "server-key", k.serverKey, "Secure communication with this key")
 	flags.IntVar(&k.serverPort, "server-port", k.serverPort, "handle user request using this port")
 
+	k.shutdownOptions.AddFlags(cmd)
+
 	flags.StringVar(&k.serviceProxyCACertPath, "service-proxy-ca-cert", k.serviceProxyCACertPath, "The path to the CA certificate of the service proxy server")
 
 	flags.StringVar(&k.agentInstallNamespace, "agent-install-namespace", k.agentInstallNamespace, "The namespace of the agent install")
+
+	k.proxyServerEndpointsOptions.addFlags(cmd)
+	k.tracingOptions.AddFlags(cmd)
+	k.rateLimitOptions.addFlags(cmd)
+	k.fairnessOptions.addFlags(cmd)
+	k.circuitBreakerOptions.addFlags(cmd)
+	k.retryOptions.addFlags(cmd)
+	k.localClusterOptions.addFlags(cmd)
+	k.agentIdentifierOptions.addFlags(cmd)
+	k.clusterHostOptions.addFlags(cmd)
+	k.clusterReferenceOptions.addFlags(cmd)
+	k.responseRewriteOptions.addFlags(cmd)
 }
 
 func (k *userServer) Validate() error {
@@ -104,35 +159,100 @@ func (k *userServer) Validate() error {
 		return fmt.Errorf("The serviceproxy-ca-cert is required")
 	}
 
-	return nil
+	if err := k.agentIdentifierOptions.validate(); err != nil {
+		return err
+	}
+
+	if err := k.clusterHostOptions.validate(); err != nil {
+		return err
+	}
+	if err := k.localClusterOptions.validate(); err != nil {
+		return err
+	}
+
+	if err := k.responseRewriteOptions.validate(); err != nil {
+		return err
+	}
+
+	return k.tracingOptions.Validate()
 }
 
 func newUserServer() *userServer {
-	return &userServer{}
+	return &userServer{
+		proxyServerEndpointsOptions: &proxyServerEndpointsOptions{},
+		shutdownOptions:             utils.NewShutdownOptions(),
+		drainer:                     utils.NewDrainer(),
+		tracingOptions:              tracing.NewOptions(),
+		rateLimitOptions:            &rateLimitOptions{},
+		fairnessOptions:             newFairnessOptions(),
+		circuitBreakerOptions:       newCircuitBreakerOptions(),
+		retryOptions:                newRetryOptions(),
+		localClusterOptions:         &localClusterOptions{},
+		agentIdentifierOptions:      newAgentIdentifierOptions(),
+		clusterHostOptions:          &clusterHostOptions{},
+		clusterReferenceOptions:     &clusterReferenceOptions{},
+		responseRewriteOptions:      newResponseRewriteOptions(),
+	}
 }
 
 func (k *userServer) init(ctx context.Context) error {
-	proxyTLSCfg, err := util.GetClientTLSConfig(k.proxyCACertPath, k.proxyCertPath, k.proxyKeyPath, k.proxyServerHost, nil)
-	if err != nil {
+	// the certificates are reloaded when they are rotated, and used by the new connections
+	var err error
+	if k.servingCert, err = utils.NewCertificateReloader("user-server-serving", k.serverCert, k.serverKey); err != nil {
 		return err
 	}
+	go k.servingCert.Run(ctx)
+
+	if k.clusterHostOptions.enabled() {
+		k.clusterHosts = &clusterHosts{domain: k.clusterHostOptions.domain}
+		if k.clusterHostOptions.cert != "" {
+			if k.clusterHosts.cert, err = utils.NewCertificateReloader("user-server-cluster-host", k.clusterHostOptions.cert, k.clusterHostOptions.key); err != nil {
+				return err
+			}
+			go k.clusterHosts.cert.Run(ctx)
+		}
+	}
 
-	// prepare ca for sevice proxy server
-	serviceProxyCaCert, err := os.ReadFile(k.serviceProxyCACertPath)
+	proxyCACertPaths := []string{}
+	if k.proxyCACertPath != "" {
+		proxyCACertPaths = append(proxyCACertPaths, k.proxyCACertPath)
+	}
+	proxyCA, err := utils.NewCAReloader("proxy-server-ca", proxyCACertPaths...)
 	if err != nil {
 		return err
 	}
-	serviceProxyRootCA = x509.NewCertPool()
-	if ok := serviceProxyRootCA.AppendCertsFromPEM(serviceProxyCaCert); !ok {
-		return fmt.Errorf("failed to parse service proxy ca cert")
+	go proxyCA.Run(ctx)
+
+	var proxyClientCert *utils.CertificateReloader
+	if k.proxyCertPath != "" || k.proxyKeyPath != "" {
+		if proxyClientCert, err = utils.NewCertificateReloader("proxy-client", k.proxyCertPath, k.proxyKeyPath); err != nil {
+			return err
+		}
+		go proxyClientCert.Run(ctx)
 	}
 
-	k.getTunnel = func(tunnelCtx context.Context) (konnectivity.Tunnel, error) {
+	// prepare ca for sevice proxy server
+	if k.serviceProxyCA, err = utils.NewCAReloader("service-proxy-ca", k.serviceProxyCACertPath); err != nil {
+		return err
+	}
+	go k.serviceProxyCA.Run(ctx)
+
+	k.getTunnel = func(tunnelCtx context.Context, address string) (konnectivity.Tunnel, error) {
+		// the tls server name is still the host of the proxy-server when a replica is dialed by its address
+		proxyTLSCfg := &tls.Config{
+			ServerName: k.proxyServerHost,
+			RootCAs:    proxyCA.Pool(),
+			MinVersion: tls.VersionTLS12,
+		}
+		if proxyClientCert != nil {
+			proxyTLSCfg.GetClientCertificate = proxyClientCert.GetClientCertificate
+		}
+
 		// instantiate a gprc proxy dialer
 		tunnel, err := konnectivity.CreateSingleUseGrpcTunnelWithContext(
 			ctx,
 			tunnelCtx,
-			net.JoinHostPort(k.proxyServerHost, strconv.Itoa(k.proxyServerPort)),
+			address,
 			grpc.WithTransportCredentials(grpccredentials.NewTLS(proxyTLSCfg)),
 			grpc.WithKeepaliveParams(keepalive.ClientParameters{
 				Time: time.Minute * 10,
@@ -144,83 +264,422 @@ func (k *userServer) init(ctx context.Context) error {
 		return tunnel, nil
 	}
 
-	addonClient, err := addonclient.NewForConfig(ctrl.GetConfigOrDie())
+	hubConfig := ctrl.GetConfigOrDie()
+	addonClient, err := addonclient.NewForConfig(hubConfig)
 	if err != nil {
 		return err
 	}
 	addonInformerFactory := addoninformers.NewSharedInformerFactory(addonClient, 30*time.Minute)
-	k.addonLister = addonInformerFactory.Addon().V1alpha1().ManagedClusterAddOns().Lister()
+	addonInformer := addonInformerFactory.Addon().V1alpha1().ManagedClusterAddOns()
+	k.addonLister = addonInformer.Lister()
+	k.addonSynced = addonInformer.Informer().HasSynced
 	addonInformerFactory.Start(ctx.Done())
 
+	kubeClient, err := kubernetes.NewForConfig(hubConfig)
+	if err != nil {
+		return err
+	}
+
+	if k.proxyServerEndpointsOptions.enabled() {
+		namespace, name, err := cache.SplitMetaNamespaceKey(k.proxyServerEndpointsOptions.service)
+		if err != nil {
+			return err
+		}
+		k.proxyServers = newProxyServerEndpoints()
+		if err := watchServiceEndpoints(ctx.Done(), kubeClient, namespace, name, k.proxyServerPort, k.proxyServers.update); err != nil {
+			return err
+		}
+	} else {
+		k.proxyServers = newProxyServerEndpoints(net.JoinHostPort(k.proxyServerHost, strconv.Itoa(k.proxyServerPort)))
+	}
+
+	// the caller is only required to share the capacity between users
+	if k.rateLimitOptions.userRateLimitEnabled() || k.fairnessOptions.enabled() {
+		k.callerResolver = newCallerResolver(kubeClient)
+		go k.callerResolver.run(ctx)
+	}
+
+	k.rateLimiter = newRateLimiter(k.rateLimitOptions, k.clusterRateLimit, k.knownCluster)
+	go k.rateLimiter.run(ctx)
+
+	// the proxy-agents must be registered with the agent identifiers the requests are routed to
+	dynamicClient, err := dynamic.NewForConfig(hubConfig)
+	if err != nil {
+		return err
+	}
+	if err := k.agentIdentifierOptions.checkManagedProxyConfiguration(ctx, dynamicClient); err != nil {
+		return err
+	}
+
+	clusterClient, err := clusterclient.NewForConfig(hubConfig)
+	if err != nil {
+		return err
+	}
+	// the ManagedClusters are only cached when their claims or labels are looked up
+	var clusterLister clusterlisterv1.ManagedClusterLister
+	if k.agentIdentifierOptions.strategy == agentIdentifierStrategyClaim || k.clusterReferenceOptions.enabled() {
+		clusterInformerFactory := clusterinformers.NewSharedInformerFactory(clusterClient, 30*time.Minute)
+		clusterInformer := clusterInformerFactory.Cluster().V1().ManagedClusters()
+		clusterLister = clusterInformer.Lister()
+		if k.clusterReferenceOptions.enabled() {
+			if k.clusterReferences, err = newClusterReferences(clusterInformer, k.clusterReferenceOptions); err != nil {
+				return err
+			}
+		}
+		clusterInformerFactory.Start(ctx.Done())
+		clusterInformerFactory.WaitForCacheSync(ctx.Done())
+	}
+	k.agentIdentifiers = newAgentIdentifiers(k.agentIdentifierOptions, clusterLister)
+
+	if k.localClusterOptions.enabled() {
+		k.localClusters = newLocalClusters(ctx, clusterClient, k.localClusterOptions)
+	}
+
+	k.fairness = newFairness(k.fairnessOptions)
+	k.circuitBreakers = newCircuitBreakers(k.circuitBreakerOptions, k.knownCluster)
+	go k.circuitBreakers.run(ctx)
+
+	return nil
+}
+
+// ready returns an error until the replica is synced, so that it is not sent requests by the Service of the
+// user-server before. It does not depend on the proxy-server, which is shared by all the replicas: without
+// its endpoints every replica would leave the Service at once, the requests are rejected with 503 instead.
+func (k *userServer) ready(_ *http.Request) error {
+	if !k.addonSynced() {
+		return fmt.Errorf("the ManagedClusterAddOns are not synced")
+	}
 	return nil
 }
 
+// clusterRateLimit returns the rate limit set by annotations on the cluster-proxy ManagedClusterAddOn of the cluster, if any.
+func (k *userServer) clusterRateLimit(cluster string) (float64, int, bool) {
+	addon, err := k.addonLister.ManagedClusterAddOns(cluster).Get(constant.AddonName)
+	if err != nil {
+		return 0, 0, false
+	}
+	return parseRateLimitAnnotations(addon.Annotations, k.rateLimitOptions.clusterBurst)
+}
+
+// caller returns the user sending the request, it is only resolved when a per-user policy is enabled.
+func (k *userServer) caller(req *http.Request) string {
+	if k.callerResolver == nil {
+		return ""
+	}
+	return k.callerResolver.caller(req)
+}
+
 func (k *userServer) ServeHTTP(wr http.ResponseWriter, req *http.Request) {
+	// the request id is forwarded to the service-proxy with the other request headers
+	requestID := utils.EnsureRequestID(wr, req)
+
 	if klog.V(4).Enabled() {
 		dump, err := httputil.DumpRequest(req, true)
 		if err != nil {
-			http.Error(wr, err.Error(), http.StatusBadRequest)
+			utils.HTTPError(wr, req, err.Error(), http.StatusBadRequest)
 			return
 		}
 		klog.V(4).Infof("request:\n%s", string(dump))
 	}
 
 	var tsc utils.TargetServiceConfig
-	var err error
 
-	switch utils.GetProxyType(req.RequestURI) {
-	case utils.ProxyTypeService:
-		tsc, err = utils.GetTargetServiceConfig(req.RequestURI)
-	case utils.ProxyTypeKubeAPIServer:
-		tsc, err = utils.GetTargetServiceConfigForKubeAPIServer(req.RequestURI)
+	_, parseSpan := tracing.Start(req.Context(), "ParseTargetServiceConfig")
+	// the cluster is the first segment of the request URI, or the subdomain of the host
+	requestURI, err := k.clusterHosts.requestURI(req)
+	proxyType := utils.GetProxyType(requestURI)
+	if err == nil {
+		switch proxyType {
+		case utils.ProxyTypeService:
+			tsc, err = utils.GetTargetServiceConfig(requestURI)
+		case utils.ProxyTypeKubeAPIServer:
+			tsc, err = utils.GetTargetServiceConfigForKubeAPIServer(requestURI)
+		}
+	}
+	if err == nil {
+		// the cluster may be referenced by a claim or a label instead of its name
+		var cluster string
+		if cluster, err = k.clusterReferences.resolve(tsc.Cluster); err == nil && cluster != tsc.Cluster {
+			klog.V(2).InfoS("resolved the cluster reference", "requestID", requestID, "reference", tsc.Cluster, "cluster", cluster)
+			tsc.Cluster = cluster
+		}
 	}
+	tracing.End(parseSpan, err)
+
+	typeLabel, verb := proxyTypeLabel(proxyType), requestVerb(req)
+	trace.SpanFromContext(req.Context()).SetAttributes(
+		attribute.String("cluster", tsc.Cluster),
+		attribute.String("proxy_type", typeLabel),
+		attribute.String("request_id", requestID),
+	)
+	// the cluster comes from the request, only the known clusters have their own series
+	clusterLabel := k.clusterLabel(tsc.Cluster)
+	requestsInFlight.WithLabelValues(clusterLabel, typeLabel).Inc()
+	defer requestsInFlight.WithLabelValues(clusterLabel, typeLabel).Dec()
+
+	rw := utils.NewResponseRecorder(wr)
+	defer func(start time.Time) {
+		recordRequest(clusterLabel, typeLabel, verb, rw, start)
+		klog.V(2).InfoS("request handled", "requestID", requestID, "cluster", tsc.Cluster, "verb", verb,
+			"path", req.URL.Path, "code", rw.StatusCode(), "duration", time.Since(start))
+	}(time.Now())
+
 	if err != nil {
-		http.Error(wr, err.Error(), http.StatusBadRequest)
+		code := http.StatusBadRequest
+		if errors.Is(err, errMisdirectedRequest) {
+			// the client retries on a new connection
+			code = http.StatusMisdirectedRequest
+		}
+		klog.ErrorS(err, "failed to parse the target service", "requestID", requestID, "host", req.Host, "requestURI", req.RequestURI)
+		utils.HTTPError(rw, req, err.Error(), code)
+		return
+	}
+
+	// the cluster comes from the request, the unknown ones are rejected before they get a rate limiter
+	if !k.knownCluster(tsc.Cluster) {
+		rejectedRequests.WithLabelValues(clusterLabel, rejectReasonUnknownCluster).Inc()
+		klog.V(2).InfoS("request to an unknown cluster", "requestID", requestID, "cluster", tsc.Cluster)
+		utils.HTTPError(rw, req, fmt.Sprintf("cluster %s not found", tsc.Cluster), http.StatusNotFound)
+		return
+	}
+
+	caller, ok, retryAfter := k.rateLimiter.admit(tsc.Cluster, func() string { return k.caller(req) }, time.Now())
+	if !ok {
+		rejectedRequests.WithLabelValues(clusterLabel, rejectReasonRateLimit).Inc()
+		klog.V(2).InfoS("request is rate limited", "requestID", requestID, "cluster", tsc.Cluster, "caller", caller, "retryAfter", retryAfter)
+		utils.WriteStatusError(rw, req, apierrors.NewTooManyRequests(
+			fmt.Sprintf("too many requests to cluster %s, please retry later", tsc.Cluster), retryAfterSeconds(retryAfter)))
 		return
 	}
 
-	targetURL, err := url.Parse(serviceProxyURL(tsc.Cluster))
+	class := classifyRequest(req, proxyType)
+	release, err := k.fairness.acquire(req.Context(), class, caller)
 	if err != nil {
-		http.Error(wr, err.Error(), http.StatusBadRequest)
+		if req.Context().Err() != nil {
+			// the client is gone
+			return
+		}
+		reason := rejectReasonQueueTimeout
+		if errors.Is(err, errQueueFull) {
+			reason = rejectReasonQueueFull
+		}
+		rejectedRequests.WithLabelValues(clusterLabel, reason).Inc()
+		klog.V(2).InfoS("request is rejected by fairness", "requestID", requestID, "cluster", tsc.Cluster, "caller", caller, "class", class, "reason", err)
+		utils.WriteStatusError(rw, req, apierrors.NewTooManyRequests(
+			fmt.Sprintf("too many %s requests, please retry later: %v", class, err), 1))
 		return
 	}
+	defer release()
+
+	if proxyType == utils.ProxyTypeService {
+		if rewriter := k.responseRewriteOptions.newResponseRewriter(req, requestURI, tsc); rewriter != nil {
+			rewriter.prepareRequest(req)
+			req = req.WithContext(withResponseRewriter(req.Context(), rewriter))
+		}
+	}
+
+	k.proxy(rw, req, tsc, class)
+}
 
-	tunnel, err := k.getTunnel(req.Context())
+// proxy forwards the request to the service-proxy of the target cluster through the ANP tunnel, or
+// directly if the target cluster is the hub itself.
+func (k *userServer) proxy(wr http.ResponseWriter, req *http.Request, tsc utils.TargetServiceConfig, class requestClass) {
+	serviceProxyURL, err := k.agentIdentifiers.serviceProxyURL(tsc.Cluster)
 	if err != nil {
-		http.Error(wr, err.Error(), http.StatusBadRequest)
+		klog.ErrorS(err, "failed to get the agent identifier", "requestID", req.Header.Get(utils.HeaderRequestID), "cluster", tsc.Cluster)
+		utils.HTTPError(wr, req, err.Error(), http.StatusNotFound)
+		return
+	}
+	targetURL, err := url.Parse(serviceProxyURL)
+	if err != nil {
+		utils.HTTPError(wr, req, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	timing := utils.NewServerTimingFromRequest(req, "user-server")
+	retries := k.retryOptions.newRetryBudget(req, class)
+
+	if k.localClusters.isLocal(tsc.Cluster) {
+		trace.SpanFromContext(req.Context()).SetAttributes(attribute.Bool("local_cluster", true))
+		// the circuit breaker tracks the proxy-agent of the cluster, which is not involved
+		dial := k.localClusters.dialer(tsc.Cluster, req.Header.Get(utils.HeaderRequestID), timing, retries)
+		k.serveProxy(wr, req, tsc, targetURL, timing, func(circuitResult) {}, dial)
+		return
+	}
+
+	if k.proxyServers.size() == 0 {
+		// not a failure of the cluster, the circuit breaker is not involved
+		utils.WriteStatusError(wr, req, utils.NewServiceUnavailable(errNoProxyServerEndpoint.Error(), 1))
+		return
+	}
+
+	report, retryAfter, ok := k.circuitBreakers.allow(tsc.Cluster)
+	if !ok {
+		rejectedRequests.WithLabelValues(k.clusterLabel(tsc.Cluster), rejectReasonCircuitOpen).Inc()
+		utils.WriteStatusError(wr, req, utils.NewServiceUnavailable(
+			fmt.Sprintf("the cluster %s is unreachable, the requests to it fail fast until its proxy-agent reconnects", tsc.Cluster),
+			retryAfterSeconds(retryAfter)))
+		return
+	}
+	// the results not reported below tell nothing about the cluster
+	defer report(circuitIgnored)
+
+	// the proxy-server replicas tried since the last retry
+	tried := map[string]bool{}
+
+	tunnel, address, err := k.createTunnel(req.Context(), tsc.Cluster, timing, retries, tried)
+	if err != nil {
+		if req.Context().Err() == nil {
+			report(circuitFailure)
+		}
+		klog.ErrorS(err, "failed to create tunnel", "requestID", req.Header.Get(utils.HeaderRequestID), "cluster", tsc.Cluster)
+		timing.WriteHeader(wr.Header())
+		utils.HTTPError(wr, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		klog.V(4).Infof("proxy dial to %s", addr)
+		// TODO: may find a way to cache the proxyConn.
+		for {
+			_, span := tracing.Start(ctx, "TunnelDial")
+			start := time.Now()
+			conn, err := tunnel.DialContext(ctx, network, addr)
+			tunnelDialDuration.WithLabelValues(k.clusterLabel(tsc.Cluster)).Observe(time.Since(start).Seconds())
+			timing.Since("dial", "dial service-proxy through ANP tunnel", start)
+			tracing.End(span, err)
+			if err == nil {
+				k.proxyServers.succeeded(tsc.Cluster, address)
+				return conn, nil
+			}
+			tunnelDialErrors.WithLabelValues(k.clusterLabel(tsc.Cluster), dialErrorReason(err)).Inc()
+			k.proxyServers.failed(tsc.Cluster, address)
+			if ctx.Err() != nil {
+				return nil, err
+			}
+
+			// the proxy-agent of the cluster may be connected to another replica of the proxy-server,
+			// and the tunnel is single use, so a new one is required either to fail over or to retry
+			if next, nextAddress, nextErr := k.nextTunnel(ctx, tsc.Cluster, timing, tried); nextErr == nil {
+				proxyServerFailovers.WithLabelValues(k.clusterLabel(tsc.Cluster)).Inc()
+				klog.V(2).InfoS("fail over to another proxy-server", "requestID", req.Header.Get(utils.HeaderRequestID), "cluster", tsc.Cluster, "from", address, "to", nextAddress, "err", err)
+				tunnel, address = next, nextAddress
+				continue
+			}
+
+			if !retries.wait(ctx) {
+				return nil, err
+			}
+			retriesTotal.WithLabelValues(k.clusterLabel(tsc.Cluster), retryPhaseDial).Inc()
+			klog.V(2).InfoS("retry to dial the service-proxy", "requestID", req.Header.Get(utils.HeaderRequestID), "cluster", tsc.Cluster, "err", err)
+			clear(tried)
+			if tunnel, address, err = k.createTunnel(ctx, tsc.Cluster, timing, retries, tried); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	k.serveProxy(wr, req, tsc, targetURL, timing, report, dial)
+}
+
+// serveProxy proxies the request to the service-proxy of the cluster, with the connections created by dial.
+func (k *userServer) serveProxy(wr http.ResponseWriter, req *http.Request, tsc utils.TargetServiceConfig, targetURL *url.URL,
+	timing *utils.ServerTiming, report func(circuitResult), dial func(ctx context.Context, network, addr string) (net.Conn, error)) {
 	proxy := httputil.NewSingleHostReverseProxy(targetURL)
-	proxy.Transport = &http.Transport{
+	proxy.Transport = otelhttp.NewTransport(&http.Transport{
 		MaxIdleConns:          100,
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 		TLSClientConfig: &tls.Config{
-			RootCAs:    serviceProxyRootCA,
+			RootCAs:    k.serviceProxyCA.Pool(),
 			MinVersion: tls.VersionTLS12,
 		},
 		// golang http pkg automaticly upgrade http connection to http2 connection, but http2 can not upgrade to SPDY which used in "kubectl exec".
 		// set ForceAttemptHTTP2 = false to prevent auto http2 upgration
 		ForceAttemptHTTP2: false,
-		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-			klog.V(4).Infof("proxy dial to %s", addr)
-			// TODO: may find a way to cache the proxyConn.
-			return tunnel.DialContext(ctx, network, addr)
-		},
+		DialContext:       dial,
+	})
+
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// the service-proxy echoes the same request id, which is already set on the response
+		resp.Header.Del(utils.HeaderRequestID)
+		timing.WriteHeader(resp.Header)
+		report(circuitSuccess)
+		if rewriter := responseRewriterFrom(resp.Request.Context()); rewriter != nil {
+			if err := rewriter.rewrite(resp); err != nil {
+				return err
+			}
+		}
+		k.drainer.WrapResponse(resp)
+		return nil
 	}
 
 	proxy.ErrorHandler = func(rw http.ResponseWriter, r *http.Request, e error) {
-		http.Error(rw, fmt.Sprintf("proxy to anp-proxy-server failed because %v", e), http.StatusBadGateway)
-		klog.Errorf("proxy to anp-proxy-server failed because %v", e)
+		if r.Context().Err() == nil {
+			report(circuitFailure)
+		}
+		timing.WriteHeader(rw.Header())
+		utils.HTTPError(rw, r, fmt.Sprintf("proxy to anp-proxy-server failed because %v", e), http.StatusBadGateway)
+		klog.Errorf("proxy to anp-proxy-server failed because %v, request id: %s", e, r.Header.Get(utils.HeaderRequestID))
 	}
 
 	klog.V(4).Infof("request scheme:%s; rawQuery:%s; path:%s", req.URL.Scheme, req.URL.RawQuery, req.URL.Path)
 
+	// the user-server is the first hop, the X-Forwarded headers sent by the client are not trusted
+	utils.SetForwardedHeaders(req, true)
+
+	ctx := tracing.WithTLSHandshakeSpan(req.Context(), "ServiceProxyTLSHandshake")
+	req = req.WithContext(timing.WithClientTrace(ctx, "service-proxy"))
 	proxy.ServeHTTP(wr, utils.UpdateRequest(tsc, req))
 }
 
+// createTunnel creates a tunnel to a replica of the ANP proxy-server, and retries while the retry budget allows it.
+// It returns the tunnel and the address of the replica.
+func (k *userServer) createTunnel(ctx context.Context, cluster string, timing *utils.ServerTiming, retries *retryBudget, tried map[string]bool) (konnectivity.Tunnel, string, error) {
+	for {
+		tunnel, address, err := k.nextTunnel(ctx, cluster, timing, tried)
+		if err == nil {
+			return tunnel, address, nil
+		}
+
+		if !retries.wait(ctx) {
+			return nil, "", err
+		}
+		retriesTotal.WithLabelValues(k.clusterLabel(cluster), retryPhaseTunnel).Inc()
+		klog.V(2).InfoS("retry to create the tunnel", "cluster", cluster, "err", err)
+		// every replica is tried again
+		clear(tried)
+	}
+}
+
+// nextTunnel creates a tunnel to the first replica of the ANP proxy-server not tried yet for the cluster.
+func (k *userServer) nextTunnel(ctx context.Context, cluster string, timing *utils.ServerTiming, tried map[string]bool) (konnectivity.Tunnel, string, error) {
+	err := errNoProxyServerEndpoint
+	for _, address := range k.proxyServers.candidates(cluster) {
+		if tried[address] {
+			continue
+		}
+		tried[address] = true
+
+		_, span := tracing.Start(ctx, "CreateTunnel", trace.WithAttributes(attribute.String("proxy_server.address", address)))
+		start := time.Now()
+		var tunnel konnectivity.Tunnel
+		tunnel, err = k.getTunnel(ctx, address)
+		timing.Since("tunnel", "create ANP tunnel", start)
+		tracing.End(span, err)
+		if err == nil {
+			return tunnel, address, nil
+		}
+		tunnelDialErrors.WithLabelValues(k.clusterLabel(cluster), dialErrorReasonTunnel).Inc()
+		k.proxyServers.failed(cluster, address)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, "", err
+}
+
 func (k *userServer) Run(ctx context.Context) error {
 	var err error
 
@@ -230,17 +689,24 @@ func (k *userServer) Run(ctx context.Context) error {
 		klog.Fatal(err)
 	}
 
-	if err = k.init(ctx); err != nil {
+	// ctx only triggers the shutdown, the tunnels of the requests drained meanwhile are still created
+	if err = k.init(k.drainer.Context()); err != nil {
 		klog.Fatal(err)
 	}
 
-	cc, err := addonutils.NewConfigChecker("user-server", k.proxyCACertPath, k.proxyCertPath, k.proxyKeyPath, k.serverCert, k.serverKey, k.serviceProxyCACertPath)
+	shutdownTracing, err := tracing.Init(ctx, "cluster-proxy-user-server", k.tracingOptions)
 	if err != nil {
 		klog.Fatal(err)
 	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			klog.Errorf("failed to shutdown tracing: %v", err)
+		}
+	}()
 
+	// the certificates are reloaded in place, so the liveness probe does not check them
 	go func() {
-		if err = utils.ServeHealthProbes(":8000", cc.Check); err != nil {
+		if err = utils.ServeProbes(":8000", nil, []healthz.Checker{k.ready, k.drainer.Ready}); err != nil {
 			klog.Fatal(err)
 		}
 	}()
@@ -248,22 +714,17 @@ func (k *userServer) Run(ctx context.Context) error {
 	klog.Infof("start https server on %d", k.serverPort)
 
 	s := &http.Server{
-		Addr:      fmt.Sprintf(":%d", k.serverPort),
-		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
-		Handler:   k,
+		Addr: fmt.Sprintf(":%d", k.serverPort),
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: k.getCertificate,
+		},
+		Handler: otelhttp.NewHandler(k, "user-server"),
 	}
 
-	err = s.ListenAndServeTLS(k.serverCert, k.serverKey)
-	if err != nil {
+	if err := utils.RunServer(ctx, s, k.shutdownOptions, k.drainer); err != nil {
 		klog.Fatalf("failed to start user proxy server: %v", err)
 	}
 
 	return nil
 }
-
-// here use the same logic as in the cluster-proxy repo:
-// https://github.com/stolostron/cluster-proxy/blob/304b2ded6c1a651be9ba0f15af4edf1f65ac29df/pkg/proxyagent/agent/agent.go#L297
-func serviceProxyURL(clusterName string) string {
-	serviceProxyHost := fmt.Sprintf("cluster-%x", sha256.Sum256([]byte(clusterName)))[:64-len("cluster-")] + ".open-cluster-management.proxy"
-	return fmt.Sprintf("https://%s:%d", serviceProxyHost, constant.ServiceProxyPort)
-}
@@ -0,0 +1,257 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/klog/v2"
+)
+
+// certificateResyncPeriod is how often the files are reloaded, in case a change is not notified.
+const certificateResyncPeriod = time.Minute
+
+var certificateExpiration = metrics.NewGaugeVec(
+	&metrics.GaugeOpts{
+		Namespace: "open_cluster_management_cluster_proxy_addon",
+		Name:      "certificate_expiration_timestamp_seconds",
+		Help:      "Expiration time of the certificates currently loaded, as a unix timestamp. The earliest expiration is reported for a CA bundle.",
+	},
+	[]string{"name"},
+)
+
+func init() {
+	legacyregistry.MustRegister(certificateExpiration)
+}
+
+// CertificateReloader holds a key pair loaded from files, and reloads it when the files change, so that
+// a rotated certificate is used by the new connections without restarting the process.
+type CertificateReloader struct {
+	name              string
+	certFile, keyFile string
+
+	lock    sync.Mutex
+	content []byte
+	cert    atomic.Pointer[tls.Certificate]
+}
+
+// NewCertificateReloader loads the key pair, the name identifies it in the logs and the metrics.
+func NewCertificateReloader(name, certFile, keyFile string) (*CertificateReloader, error) {
+	r := &CertificateReloader{name: name, certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertificateReloader) reload() error {
+	certPEM, err := os.ReadFile(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := os.ReadFile(r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	content := append(append([]byte{}, certPEM...), keyPEM...)
+	if bytes.Equal(content, r.content) {
+		return nil
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("failed to load the key pair %s and %s: %v", r.certFile, r.keyFile, err)
+	}
+	r.content = content
+	r.cert.Store(&cert)
+
+	notAfter := cert.Leaf.NotAfter
+	certificateExpiration.WithLabelValues(r.name).Set(float64(notAfter.Unix()))
+	klog.Infof("loaded the certificate %s from %s, it expires at %s", r.name, r.certFile, notAfter)
+	return nil
+}
+
+// GetCertificate returns the key pair to a client, it is used as the GetCertificate of a tls.Config.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// GetClientCertificate returns the key pair to a server, it is used as the GetClientCertificate of a tls.Config.
+func (r *CertificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// Run reloads the key pair when the files change until the context is done.
+func (r *CertificateReloader) Run(ctx context.Context) {
+	WatchFiles(ctx, r.name, []string{r.certFile, r.keyFile}, r.reload)
+}
+
+// CAReloader holds a pool of CA certificates loaded from files, and reloads it when the files change.
+type CAReloader struct {
+	name  string
+	files []string
+
+	lock    sync.Mutex
+	content []byte
+	pool    atomic.Pointer[x509.CertPool]
+}
+
+// NewCAReloader loads the CA certificates of the files, the name identifies them in the logs and the metrics.
+// Without files, the pool is nil so that the system pool is used.
+func NewCAReloader(name string, files ...string) (*CAReloader, error) {
+	r := &CAReloader{name: name, files: files}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CAReloader) reload() error {
+	if len(r.files) == 0 {
+		return nil
+	}
+
+	var content []byte
+	for _, file := range r.files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		content = append(append(content, data...), '\n')
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if bytes.Equal(content, r.content) {
+		return nil
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return fmt.Errorf("failed to parse the CA certificates in %v", r.files)
+	}
+	r.content = content
+	r.pool.Store(pool)
+
+	if notAfter, ok := earliestExpiration(content); ok {
+		certificateExpiration.WithLabelValues(r.name).Set(float64(notAfter.Unix()))
+	}
+	klog.Infof("loaded the CA certificates %s from %v", r.name, r.files)
+	return nil
+}
+
+// Pool returns the CA certificates currently loaded.
+func (r *CAReloader) Pool() *x509.CertPool {
+	return r.pool.Load()
+}
+
+// Run reloads the CA certificates when the files change until the context is done.
+func (r *CAReloader) Run(ctx context.Context) {
+	if len(r.files) == 0 {
+		return
+	}
+	WatchFiles(ctx, r.name, r.files, r.reload)
+}
+
+// earliestExpiration returns the earliest expiration of the certificates in the PEM data.
+func earliestExpiration(data []byte) (time.Time, bool) {
+	var earliest time.Time
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if earliest.IsZero() || cert.NotAfter.Before(earliest) {
+			earliest = cert.NotAfter
+		}
+	}
+	return earliest, !earliest.IsZero()
+}
+
+// WatchFiles calls reload when the files change, and periodically, until the context is done. The parent
+// directories are watched, as the mounted Secrets and ConfigMaps are updated by swapping a symlink. The
+// previous content is kept when reload fails, e.g. while the files are being updated.
+func WatchFiles(ctx context.Context, name string, files []string, reload func() error) {
+	WatchFileSet(ctx, name, func() []string { return files }, reload)
+}
+
+// WatchFileSet is WatchFiles for a set of files which can change on reload, e.g. the files referenced by a
+// kubeconfig. The files are listed again after each reload, and the directories watched are updated.
+func WatchFileSet(ctx context.Context, name string, files func() []string, reload func() error) {
+	var events chan fsnotify.Event
+	var errs chan error
+	dirs := map[string]bool{}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		klog.Errorf("failed to watch the files of %s, they are reloaded every %v: %v", name, certificateResyncPeriod, err)
+	} else {
+		defer watcher.Close()
+		events, errs = watcher.Events, watcher.Errors
+	}
+	watch := func() {
+		if watcher == nil {
+			return
+		}
+		current := map[string]bool{}
+		for _, file := range files() {
+			current[filepath.Dir(file)] = true
+		}
+		for dir := range dirs {
+			if !current[dir] {
+				_ = watcher.Remove(dir)
+				delete(dirs, dir)
+			}
+		}
+		for dir := range current {
+			if dirs[dir] {
+				continue
+			}
+			if err := watcher.Add(dir); err != nil {
+				klog.Errorf("failed to watch %s for %s: %v", dir, name, err)
+				continue
+			}
+			dirs[dir] = true
+		}
+	}
+	watch()
+
+	ticker := time.NewTicker(certificateResyncPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-events:
+		case err := <-errs:
+			klog.Errorf("failed to watch the files of %s: %v", name, err)
+			continue
+		case <-ticker.C:
+		}
+		if err := reload(); err != nil {
+			klog.Errorf("failed to reload %s, the previous one is kept: %v", name, err)
+		}
+		watch()
+	}
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeCertificate(t *testing.T, dir string, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(notAfter.Unix()),
+		Subject:               pkix.Name{CommonName: "cluster-proxy"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	certFile, keyFile := writeCertificate(t, dir, notAfter)
+
+	reloader, err := NewCertificateReloader("test", certFile, keyFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cert, _ := reloader.GetCertificate(nil)
+	if !cert.Leaf.NotAfter.Equal(notAfter) {
+		t.Errorf("expected the certificate to expire at %s, got %s", notAfter, cert.Leaf.NotAfter)
+	}
+
+	// a rotated certificate is loaded
+	rotated := notAfter.Add(time.Hour)
+	writeCertificate(t, dir, rotated)
+	if err := reloader.reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cert, _ = reloader.GetClientCertificate(nil)
+	if !cert.Leaf.NotAfter.Equal(rotated) {
+		t.Errorf("expected the rotated certificate to expire at %s, got %s", rotated, cert.Leaf.NotAfter)
+	}
+
+	// the previous certificate is kept when the files are invalid
+	if err := os.WriteFile(keyFile, []byte("invalid"), 0600); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := reloader.reload(); err == nil {
+		t.Errorf("expected an error for an invalid key")
+	}
+	if cert, _ := reloader.GetCertificate(nil); !cert.Leaf.NotAfter.Equal(rotated) {
+		t.Errorf("expected the previous certificate to be kept")
+	}
+}
+
+func TestCAReloader(t *testing.T) {
+	dir := t.TempDir()
+	notAfter := time.Now().Add(time.Hour).Truncate(time.Second)
+	certFile, _ := writeCertificate(t, dir, notAfter)
+
+	reloader, err := NewCAReloader("test", certFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	pool := reloader.Pool()
+	if pool == nil {
+		t.Fatalf("expected a CA pool")
+	}
+
+	writeCertificate(t, dir, notAfter.Add(time.Hour))
+	if err := reloader.reload(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if reloader.Pool() == pool {
+		t.Errorf("expected the CA pool to be reloaded")
+	}
+
+	if reloader, err := NewCAReloader("test"); err != nil || reloader.Pool() != nil {
+		t.Errorf("expected a nil CA pool without files, got %v, %v", reloader.Pool(), err)
+	}
+}
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	HeaderForwarded       = "Forwarded"
+	HeaderForwardedFor    = "X-Forwarded-For"
+	HeaderForwardedHost   = "X-Forwarded-Host"
+	HeaderForwardedProto  = "X-Forwarded-Proto"
+	HeaderForwardedPrefix = "X-Forwarded-Prefix"
+)
+
+// SetForwardedHeaders tells the next hop where the request comes from. It appends an element for the client
+// of the request, its host and its protocol to the Forwarded header (RFC 7239), and sets the X-Forwarded-Host
+// and X-Forwarded-Proto headers, keeping the ones set by a previous proxy unless override is true, e.g. on the
+// first hop where they are sent by the client. The X-Forwarded-For header is appended by httputil.ReverseProxy,
+// with override the Forwarded and X-Forwarded-For headers sent by the client are removed first, so that the
+// services do not trust the addresses the client claims to be forwarded for.
+func SetForwardedHeaders(req *http.Request, override bool) {
+	if override {
+		req.Header.Del(HeaderForwarded)
+		req.Header.Del(HeaderForwardedFor)
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	element := "host=" + forwardedValue(req.Host) + ";proto=" + proto
+	if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if strings.Contains(clientIP, ":") {
+			// the IPv6 addresses are quoted and bracketed
+			clientIP = "[" + clientIP + "]"
+		}
+		element = "for=" + forwardedValue(clientIP) + ";" + element
+	}
+	if prior := req.Header.Values(HeaderForwarded); len(prior) > 0 {
+		element = strings.Join(prior, ", ") + ", " + element
+	}
+	req.Header.Set(HeaderForwarded, element)
+
+	if override || req.Header.Get(HeaderForwardedHost) == "" {
+		req.Header.Set(HeaderForwardedHost, req.Host)
+	}
+	if override || req.Header.Get(HeaderForwardedProto) == "" {
+		req.Header.Set(HeaderForwardedProto, proto)
+	}
+}
+
+// forwardedValue quotes the value of a Forwarded parameter unless it is a token.
+func forwardedValue(value string) string {
+	for _, c := range value {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+		}
+	}
+	return value
+}
+
+func isTokenChar(c rune) bool {
+	return c < 0x7f && (c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || strings.ContainsRune("!#$%&'*+-.^_`|~", c))
+}
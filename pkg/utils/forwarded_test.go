@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetForwardedHeaders(t *testing.T) {
+	testcases := []struct {
+		name          string
+		remoteAddr    string
+		host          string
+		header        http.Header
+		override      bool
+		expectFwd     string
+		expectFwdHost string
+		expectFwdFor  string
+	}{
+		{
+			name:       "first hop",
+			remoteAddr: "192.0.2.10:51234",
+			host:       "cluster-proxy-user.apps.hub.example.com",
+			header: http.Header{
+				HeaderForwarded:     []string{"for=10.0.0.1;host=spoofed.example.com"},
+				HeaderForwardedFor:  []string{"10.0.0.1"},
+				HeaderForwardedHost: []string{"spoofed.example.com"},
+			},
+			override:      true,
+			expectFwd:     "for=192.0.2.10;host=cluster-proxy-user.apps.hub.example.com;proto=https",
+			expectFwdHost: "cluster-proxy-user.apps.hub.example.com",
+		},
+		{
+			name:       "second hop",
+			remoteAddr: "[2001:db8::1]:51234",
+			host:       "cluster-proxy-user.apps.hub.example.com:443",
+			header: http.Header{
+				HeaderForwarded:     []string{"for=192.0.2.10;host=cluster-proxy-user.apps.hub.example.com;proto=https"},
+				HeaderForwardedFor:  []string{"192.0.2.10"},
+				HeaderForwardedHost: []string{"cluster-proxy-user.apps.hub.example.com"},
+			},
+			expectFwd: `for=192.0.2.10;host=cluster-proxy-user.apps.hub.example.com;proto=https, ` +
+				`for="[2001:db8::1]";host="cluster-proxy-user.apps.hub.example.com:443";proto=https`,
+			expectFwdHost: "cluster-proxy-user.apps.hub.example.com",
+			expectFwdFor:  "192.0.2.10",
+		},
+	}
+
+	for _, tc := range testcases {
+		req := httptest.NewRequest(http.MethodGet, "https://route-domain/cluster1/api/pods", nil)
+		req.RemoteAddr = tc.remoteAddr
+		req.Host = tc.host
+		req.TLS = &tls.ConnectionState{}
+		for key, values := range tc.header {
+			req.Header[key] = values
+		}
+
+		SetForwardedHeaders(req, tc.override)
+		if actual := req.Header.Get(HeaderForwarded); actual != tc.expectFwd {
+			t.Errorf("%s: expected Forwarded %q, got %q", tc.name, tc.expectFwd, actual)
+		}
+		if actual := req.Header.Get(HeaderForwardedHost); actual != tc.expectFwdHost {
+			t.Errorf("%s: expected X-Forwarded-Host %q, got %q", tc.name, tc.expectFwdHost, actual)
+		}
+		if actual := req.Header.Get(HeaderForwardedFor); actual != tc.expectFwdFor {
+			t.Errorf("%s: expected X-Forwarded-For %q, got %q", tc.name, tc.expectFwdFor, actual)
+		}
+		if actual := req.Header.Get(HeaderForwardedProto); actual != "https" {
+			t.Errorf("%s: expected X-Forwarded-Proto https, got %q", tc.name, actual)
+		}
+	}
+}
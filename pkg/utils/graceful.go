@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/klog/v2"
+)
+
+type ShutdownOptions struct {
+	// Delay is how long the readiness probe fails before the server stops accepting connections,
+	// so that the endpoints of the pod are removed from the Services first.
+	Delay time.Duration
+	// GracePeriod is how long the requests in flight are given to finish once the server stops
+	// accepting connections.
+	GracePeriod time.Duration
+}
+
+func NewShutdownOptions() *ShutdownOptions {
+	return &ShutdownOptions{
+		Delay:       5 * time.Second,
+		GracePeriod: 20 * time.Second,
+	}
+}
+
+func (o *ShutdownOptions) AddFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+
+	flags.DurationVar(&o.Delay, "shutdown-delay", o.Delay, "How long the readiness probe fails on SIGTERM before the server stops accepting connections")
+	flags.DurationVar(&o.GracePeriod, "shutdown-grace-period", o.GracePeriod, "How long the requests in flight are given to finish once the server stops accepting connections, "+
+		"the upgraded connections (exec, attach and port-forward) still open at its end are closed. It should fit in the terminationGracePeriodSeconds of the pod with --shutdown-delay")
+}
+
+// Drainer drains the proxied responses when the server shuts down. The watches and the log follows
+// end cleanly as soon as the draining starts, so that their clients reconnect to another replica,
+// and the upgraded connections are closed at the end of the grace period.
+type Drainer struct {
+	shuttingDown atomic.Bool
+
+	draining context.Context
+	drain    context.CancelFunc
+	// serving is done once the server is shut down
+	serving context.Context
+	stop    context.CancelFunc
+
+	lock     sync.Mutex
+	upgraded map[*upgradedBody]struct{}
+}
+
+func NewDrainer() *Drainer {
+	draining, drain := context.WithCancel(context.Background())
+	serving, stop := context.WithCancel(context.Background())
+	return &Drainer{
+		draining: draining,
+		drain:    drain,
+		serving:  serving,
+		stop:     stop,
+		upgraded: map[*upgradedBody]struct{}{},
+	}
+}
+
+// Context returns a context which is done once the server is shut down, for what the requests in flight
+// depend on, e.g. the tunnels they are proxied through and the informers. Unlike the context triggering
+// the shutdown, it is not done while the requests are drained.
+func (d *Drainer) Context() context.Context {
+	return d.serving
+}
+
+// Ready is a readiness check failing once the server is shutting down.
+func (d *Drainer) Ready(_ *http.Request) error {
+	if d.shuttingDown.Load() {
+		return fmt.Errorf("the server is shutting down")
+	}
+	return nil
+}
+
+// WrapResponse wraps the body of a proxied response, it is used in the ModifyResponse of a ReverseProxy.
+func (d *Drainer) WrapResponse(resp *http.Response) {
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if conn, ok := resp.Body.(io.ReadWriteCloser); ok {
+			body := &upgradedBody{ReadWriteCloser: conn, drainer: d}
+			d.lock.Lock()
+			d.upgraded[body] = struct{}{}
+			d.lock.Unlock()
+			resp.Body = body
+		}
+		return
+	}
+
+	if resp.Request == nil || !isStreamingRequest(resp.Request) {
+		return
+	}
+	body := &drainingBody{ReadCloser: resp.Body, draining: d.draining}
+	// the read in progress is interrupted by closing the body
+	body.stop = context.AfterFunc(d.draining, func() {
+		resp.Body.Close()
+	})
+	resp.Body = body
+}
+
+// drainingBody ends at EOF once the draining starts, so that the stream ends cleanly.
+type drainingBody struct {
+	io.ReadCloser
+	draining context.Context
+	stop     func() bool
+}
+
+func (b *drainingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && b.draining.Err() != nil {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+func (b *drainingBody) Close() error {
+	b.stop()
+	return b.ReadCloser.Close()
+}
+
+// upgradedBody is the connection to the backend of an upgraded request.
+type upgradedBody struct {
+	io.ReadWriteCloser
+	drainer *Drainer
+	once    sync.Once
+}
+
+func (b *upgradedBody) Close() error {
+	b.once.Do(func() {
+		b.drainer.lock.Lock()
+		delete(b.drainer.upgraded, b)
+		b.drainer.lock.Unlock()
+	})
+	return b.ReadWriteCloser.Close()
+}
+
+// upgradedConnections returns the number of upgraded connections open.
+func (d *Drainer) upgradedConnections() int {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return len(d.upgraded)
+}
+
+// closeUpgraded closes the upgraded connections, once the context is done if they are not closed before.
+func (d *Drainer) closeUpgraded(ctx context.Context) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for d.upgradedConnections() > 0 {
+		select {
+		case <-ctx.Done():
+			d.lock.Lock()
+			upgraded := make([]*upgradedBody, 0, len(d.upgraded))
+			for body := range d.upgraded {
+				upgraded = append(upgraded, body)
+			}
+			d.lock.Unlock()
+
+			klog.Infof("closing %d upgraded connections at the end of the grace period", len(upgraded))
+			for _, body := range upgraded {
+				body.Close()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// isStreamingRequest returns whether the response to the request is streamed until the client goes away.
+func isStreamingRequest(req *http.Request) bool {
+	query := req.URL.Query()
+	if watch, _ := strconv.ParseBool(query.Get("watch")); watch {
+		return true
+	}
+	if strings.HasSuffix(req.URL.Path, "/log") {
+		if follow, _ := strconv.ParseBool(query.Get("follow")); follow {
+			return true
+		}
+	}
+	return false
+}
+
+// RunServer serves TLS with the certificates of the TLSConfig of the server until the context is done,
+// then shuts the server down gracefully: the readiness check of the drainer fails, the server stops
+// accepting connections after the shutdown delay, the streams end, and the requests in flight are given
+// the grace period to finish. The context of the drainer is done once the server is shut down.
+func RunServer(ctx context.Context, server *http.Server, options *ShutdownOptions, drainer *Drainer) error {
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		drainer.stop()
+		return err
+	}
+	return serve(ctx, server, listener, options, drainer)
+}
+
+func serve(ctx context.Context, server *http.Server, listener net.Listener, options *ShutdownOptions, drainer *Drainer) error {
+	defer drainer.stop()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ServeTLS(listener, "", "")
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	klog.Infof("shutting down the server in %v", options.Delay)
+	drainer.shuttingDown.Store(true)
+	time.Sleep(options.Delay)
+
+	drainer.drain()
+	graceCtx, cancel := context.WithTimeout(context.Background(), options.GracePeriod)
+	defer cancel()
+	if err := server.Shutdown(graceCtx); err != nil {
+		klog.Warningf("the requests in flight did not finish in the grace period: %v", err)
+		server.Close()
+	}
+	drainer.closeUpgraded(graceCtx)
+
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	klog.Infof("the server is shut down")
+	return nil
+}
@@ -0,0 +1,177 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/util/cert"
+)
+
+func TestDrainerStreams(t *testing.T) {
+	drainer := NewDrainer()
+
+	watchBody, watchWriter := io.Pipe()
+	watch := &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       watchBody,
+		Request:    httptest.NewRequest(http.MethodGet, "https://kubernetes.default.svc/api/v1/pods?watch=true", nil),
+	}
+	drainer.WrapResponse(watch)
+
+	listBody, _ := io.Pipe()
+	list := &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       listBody,
+		Request:    httptest.NewRequest(http.MethodGet, "https://kubernetes.default.svc/api/v1/pods", nil),
+	}
+	drainer.WrapResponse(list)
+	if list.Body != io.ReadCloser(listBody) {
+		t.Errorf("expected the body of a short response not to be wrapped")
+	}
+
+	go func() {
+		_, _ = watchWriter.Write([]byte("event"))
+	}()
+	buf := make([]byte, 16)
+	if n, err := watch.Body.Read(buf); err != nil || string(buf[:n]) != "event" {
+		t.Fatalf("expected to read the event, got %q, %v", buf[:n], err)
+	}
+
+	// the blocked read ends at EOF once the draining starts
+	read := make(chan error, 1)
+	go func() {
+		_, err := watch.Body.Read(buf)
+		read <- err
+	}()
+	drainer.drain()
+	select {
+	case err := <-read:
+		if err != io.EOF {
+			t.Errorf("expected EOF, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the read to end once the draining starts")
+	}
+}
+
+type fakeConn struct {
+	io.ReadWriter
+	closed bool
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestDrainerUpgradedConnections(t *testing.T) {
+	drainer := NewDrainer()
+
+	closedByClient := &fakeConn{}
+	exec := &fakeConn{}
+	for _, conn := range []*fakeConn{closedByClient, exec} {
+		resp := &http.Response{StatusCode: http.StatusSwitchingProtocols, Body: conn}
+		drainer.WrapResponse(resp)
+		if _, ok := resp.Body.(io.ReadWriteCloser); !ok {
+			t.Fatalf("expected the body of an upgraded response to stay an io.ReadWriteCloser")
+		}
+		if conn == closedByClient {
+			resp.Body.Close()
+		}
+	}
+	if drainer.upgradedConnections() != 1 {
+		t.Errorf("expected 1 upgraded connection, got %d", drainer.upgradedConnections())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	drainer.closeUpgraded(ctx)
+	if !exec.closed || drainer.upgradedConnections() != 0 {
+		t.Errorf("expected the upgraded connection to be closed at the end of the grace period")
+	}
+}
+
+func TestDrainerReady(t *testing.T) {
+	drainer := NewDrainer()
+	if err := drainer.Ready(nil); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	drainer.shuttingDown.Store(true)
+	if err := drainer.Ready(nil); err == nil {
+		t.Errorf("expected the readiness check to fail once shutting down")
+	}
+}
+
+func TestRunServerServingContext(t *testing.T) {
+	certPEM, keyPEM, err := cert.GenerateSelfSignedCertKey("localhost", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the connections to the upstream are dialed with the context of the drainer, as the tunnels are
+	drainer := NewDrainer()
+	proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+	proxy.Transport = &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(_ context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(drainer.Context(), network, addr)
+		},
+	}
+	server := &http.Server{
+		Handler:   proxy,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{certificate}},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- serve(ctx, server, listener, &ShutdownOptions{Delay: 500 * time.Millisecond, GracePeriod: time.Second}, drainer)
+	}()
+
+	// the request is proxied during the shutdown delay, after the context is canceled
+	cancel()
+	for drainer.Ready(nil) == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + listener.Addr().String())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the request to be proxied while shutting down, got %s", resp.Status)
+	}
+
+	if err := <-serveErr; err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+	if drainer.Context().Err() == nil {
+		t.Errorf("expected the context of the drainer to be done once the server is shut down")
+	}
+}
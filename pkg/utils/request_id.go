@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+// HeaderRequestID is the header carrying the id used to correlate a request across the user-server,
+// the service-proxy and the target.
+const HeaderRequestID = "X-Request-Id"
+
+// validRequestID limits the request ids accepted from clients, so they are safe to log and to forward.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// EnsureRequestID makes sure the request carries a valid request id, keeps the one sent by the
+// client if any, otherwise generates a new one. The request id is also set on the response headers.
+func EnsureRequestID(rw http.ResponseWriter, req *http.Request) string {
+	id := req.Header.Get(HeaderRequestID)
+	if !validRequestID.MatchString(id) {
+		id = uuid.NewString()
+		req.Header.Set(HeaderRequestID, id)
+	}
+	rw.Header().Set(HeaderRequestID, id)
+	return id
+}
+
+// HTTPError replies to the request with the error message and the request id, so that the error
+// reported by the client can be correlated with the logs.
+func HTTPError(rw http.ResponseWriter, req *http.Request, error string, code int) {
+	if id := req.Header.Get(HeaderRequestID); id != "" {
+		error = fmt.Sprintf("%s (request id: %s)", error, id)
+	}
+	http.Error(rw, error, code)
+}
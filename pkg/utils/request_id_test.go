@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEnsureRequestID(t *testing.T) {
+	testcases := []struct {
+		name      string
+		requestID string
+		keep      bool
+	}{
+		{
+			name: "generated",
+		},
+		{
+			name:      "sent by client",
+			requestID: "3f1c2a10-9b7d-4e0e-8a39-1f2f6c1d2e3b",
+			keep:      true,
+		},
+		{
+			name:      "invalid",
+			requestID: "id\nwith a new line",
+		},
+	}
+
+	for _, tc := range testcases {
+		req := httptest.NewRequest(http.MethodGet, "https://route-domain/cluster1/api/pods", nil)
+		if tc.requestID != "" {
+			req.Header.Set(HeaderRequestID, tc.requestID)
+		}
+		rw := httptest.NewRecorder()
+
+		id := EnsureRequestID(rw, req)
+		if tc.keep && id != tc.requestID {
+			t.Errorf("%s: expected request id %q, got %q", tc.name, tc.requestID, id)
+		}
+		if !tc.keep && (id == tc.requestID || !validRequestID.MatchString(id)) {
+			t.Errorf("%s: expected a generated request id, got %q", tc.name, id)
+		}
+		if req.Header.Get(HeaderRequestID) != id {
+			t.Errorf("%s: expected request header %q, got %q", tc.name, id, req.Header.Get(HeaderRequestID))
+		}
+		if rw.Header().Get(HeaderRequestID) != id {
+			t.Errorf("%s: expected response header %q, got %q", tc.name, id, rw.Header().Get(HeaderRequestID))
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// ResponseRecorder wraps a http.ResponseWriter to record the status code and the
+// number of bytes written. It keeps supporting Flush and Hijack, which are required
+// by streaming and upgraded (exec, attach, port-forward) requests.
+type ResponseRecorder struct {
+	http.ResponseWriter
+	code     int
+	written  int64
+	hijacked bool
+}
+
+// NewResponseRecorder returns a ResponseRecorder wrapping rw.
+func NewResponseRecorder(rw http.ResponseWriter) *ResponseRecorder {
+	return &ResponseRecorder{ResponseWriter: rw}
+}
+
+func (r *ResponseRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *ResponseRecorder) Write(b []byte) (int, error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.written += int64(n)
+	return n, err
+}
+
+func (r *ResponseRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *ResponseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, brw, err := h.Hijack()
+	if err == nil {
+		r.hijacked = true
+	}
+	return conn, brw, err
+}
+
+func (r *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// StatusCode returns the status code sent to the client.
+func (r *ResponseRecorder) StatusCode() int {
+	switch {
+	case r.hijacked:
+		return http.StatusSwitchingProtocols
+	case r.code == 0:
+		return http.StatusOK
+	}
+	return r.code
+}
+
+// Written returns the number of body bytes written to the client.
+func (r *ResponseRecorder) Written() int64 {
+	return r.written
+}
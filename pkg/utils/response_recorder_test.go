@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResponseRecorder(t *testing.T) {
+	rec := NewResponseRecorder(httptest.NewRecorder())
+	if rec.StatusCode() != http.StatusOK {
+		t.Errorf("expected default code %d, got %d", http.StatusOK, rec.StatusCode())
+	}
+
+	rec.WriteHeader(http.StatusNotFound)
+	if _, err := rec.Write([]byte("not found")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rec.StatusCode() != http.StatusNotFound {
+		t.Errorf("expected code %d, got %d", http.StatusNotFound, rec.StatusCode())
+	}
+	if rec.Written() != int64(len("not found")) {
+		t.Errorf("expected %d bytes written, got %d", len("not found"), rec.Written())
+	}
+}
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// HeaderServerTimingRequest is the request header clients set to "true" to get a Server-Timing
+	// response header with the time spent in each hop of the proxy chain.
+	HeaderServerTimingRequest = "Cluster-Proxy-Server-Timing"
+
+	headerServerTiming = "Server-Timing"
+)
+
+// ServerTiming collects the Server-Timing metrics of a request. A nil *ServerTiming is valid and
+// records nothing, so that requests which did not ask for the timings cost nothing.
+type ServerTiming struct {
+	lock    sync.Mutex
+	prefix  string
+	metrics []string
+}
+
+// NewServerTimingFromRequest returns a ServerTiming whose metric names are prefixed with prefix if
+// the request asks for timings by HeaderServerTimingRequest, or nil otherwise.
+func NewServerTimingFromRequest(req *http.Request, prefix string) *ServerTiming {
+	if requested, _ := strconv.ParseBool(req.Header.Get(HeaderServerTimingRequest)); !requested {
+		return nil
+	}
+	return &ServerTiming{prefix: prefix}
+}
+
+// Add records the duration d of the metric name described by desc.
+func (t *ServerTiming) Add(name, desc string, d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.metrics = append(t.metrics, fmt.Sprintf("%s-%s;dur=%.3f;desc=%q", t.prefix, name, float64(d)/float64(time.Millisecond), desc))
+}
+
+// Since records the time elapsed since start of the metric name described by desc.
+func (t *ServerTiming) Since(name, desc string, start time.Time) {
+	t.Add(name, desc, time.Since(start))
+}
+
+// WriteHeader adds the recorded metrics to the Server-Timing header in h. Metrics added by the
+// next hops are kept, so the client sees the timings of the whole proxy chain.
+func (t *ServerTiming) WriteHeader(h http.Header) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.metrics) == 0 {
+		return
+	}
+	h.Add(headerServerTiming, strings.Join(t.metrics, ", "))
+}
+
+// WithClientTrace returns a context recording the TLS handshake ("tls") and the time from the
+// request being written to the first response byte ("ttfb") of the http requests made with it.
+func (t *ServerTiming) WithClientTrace(ctx context.Context, target string) context.Context {
+	if t == nil {
+		return ctx
+	}
+	var tlsStart, wroteRequest time.Time
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		TLSHandshakeStart: func() {
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.Since("tls", "TLS handshake with "+target, tlsStart)
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			wroteRequest = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			t.Since("ttfb", "first response byte from "+target, wroteRequest)
+		},
+	})
+}
@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServerTiming(t *testing.T) {
+	testcases := []struct {
+		name   string
+		header map[string]string
+		expect []string
+	}{
+		{
+			name: "not requested",
+		},
+		{
+			name:   "disabled",
+			header: map[string]string{HeaderServerTimingRequest: "false"},
+		},
+		{
+			name:   "requested",
+			header: map[string]string{HeaderServerTimingRequest: "true"},
+			expect: []string{`user-server-tunnel;dur=1.500;desc="create ANP tunnel", user-server-dial;dur=20.000;desc="dial service-proxy"`},
+		},
+	}
+
+	for _, tc := range testcases {
+		req := httptest.NewRequest(http.MethodGet, "https://route-domain/cluster1/api/pods", nil)
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+
+		timing := NewServerTimingFromRequest(req, "user-server")
+		timing.Add("tunnel", "create ANP tunnel", 1500*time.Microsecond)
+		timing.Add("dial", "dial service-proxy", 20*time.Millisecond)
+
+		header := http.Header{}
+		// the timings of the next hop must be kept
+		header.Add("Server-Timing", `service-proxy-auth;dur=3.000`)
+		timing.WriteHeader(header)
+
+		actual := header.Values("Server-Timing")[1:]
+		if len(actual) != len(tc.expect) {
+			t.Fatalf("%s: expected %v, got %v", tc.name, tc.expect, actual)
+		}
+		for i := range actual {
+			if actual[i] != tc.expect[i] {
+				t.Errorf("%s: expected %q, got %q", tc.name, tc.expect[i], actual[i])
+			}
+		}
+	}
+}
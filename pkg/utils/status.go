@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// WriteStatusError replies to the request with the error in the Kubernetes Status format, so that
+// kube clients handle it like an error returned by the kube-apiserver (e.g. retry after a 429).
+// The Retry-After header is set if the status carries RetryAfterSeconds.
+func WriteStatusError(rw http.ResponseWriter, req *http.Request, statusErr *apierrors.StatusError) {
+	status := statusErr.Status()
+	status.Kind = "Status"
+	status.APIVersion = "v1"
+	if id := req.Header.Get(HeaderRequestID); id != "" {
+		status.Message = fmt.Sprintf("%s (request id: %s)", status.Message, id)
+	}
+
+	if status.Details != nil && status.Details.RetryAfterSeconds > 0 {
+		rw.Header().Set("Retry-After", strconv.Itoa(int(status.Details.RetryAfterSeconds)))
+	}
+
+	body, err := json.Marshal(status)
+	if err != nil {
+		klog.Errorf("failed to marshal status: %v", err)
+		HTTPError(rw, req, status.Message, int(status.Code))
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(int(status.Code))
+	if _, err := rw.Write(body); err != nil {
+		klog.Errorf("failed to write status: %v", err)
+	}
+}
+
+// NewServiceUnavailable returns a 503 status error asking the client to retry after retryAfterSeconds.
+func NewServiceUnavailable(message string, retryAfterSeconds int) *apierrors.StatusError {
+	return &apierrors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusServiceUnavailable,
+		Reason:  metav1.StatusReasonServiceUnavailable,
+		Message: message,
+		Details: &metav1.StatusDetails{
+			RetryAfterSeconds: int32(retryAfterSeconds),
+		},
+	}}
+}
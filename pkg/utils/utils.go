@@ -3,22 +3,19 @@ package utils
 import (
 	"crypto/tls"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
 
 	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/component-base/metrics/legacyregistry"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 )
 
-const (
-	HEADERSERVICECA   = "Service-Root-Ca"
-	HEADERSERVICECERT = "Service-Client-Cert"
-	HEADERSERVICEKEY  = "Service-Client-Key"
-)
-
 // TargetServiceConfig is a collection of data extrict from the request URL description the target service we can to access on the managed cluster.
 // There are 2 usages of it:
 // 1. used in function `ServiceProxyURL` to construct the target service URL.
@@ -36,7 +33,8 @@ func UpdateRequest(t TargetServiceConfig, req *http.Request) *http.Request {
 	// update request URL path
 	req.URL.Path = t.Path
 
-	// populate proto, namespace, service, and port to request headers
+	// populate cluster, proto, namespace, service, and port to request headers
+	req.Header.Set("Cluster-Proxy-Cluster", t.Cluster)
 	req.Header.Set("Cluster-Proxy-Proto", t.Proto)
 	req.Header.Set("Cluster-Proxy-Namespace", t.Namespace)
 	req.Header.Set("Cluster-Proxy-Service", t.Service)
@@ -80,6 +78,18 @@ func GetTargetServiceConfig(requestURL string) (ts TargetServiceConfig, err erro
 	}, nil
 }
 
+// GetServicePathPrefix extrict the path prefix of the target service from requestURL, the path of the target
+// service is relative to it
+// input: https://<route location cluster-proxy>/cluster1/api/v1/namespaces/default/services/<https:helloworld:8080>/proxy-service/ping?time-out=32s
+// output: /cluster1/api/v1/namespaces/default/services/<https:helloworld:8080>/proxy-service
+func GetServicePathPrefix(requestURL string) string {
+	urlparams := strings.Split(strings.Split(requestURL, "?")[0], "/")
+	if len(urlparams) < 9 {
+		return ""
+	}
+	return strings.Join(urlparams[:9], "/")
+}
+
 // GetTargetServiceConfigForKubeAPIServer extrict the kube apiserver config from requestURL
 // input: https://<route location cluster-proxy>/cluster1/api/pods?timeout=32s
 // output: TargetServiceConfig{Cluster: cluster1, Proto: https, Service: kubernetes, Namespace: default, Port: 443, Path: api/pods}
@@ -104,6 +114,12 @@ func GetTargetServiceConfigForKubeAPIServer(requestURL string) (ts TargetService
 	return ts, nil
 }
 
+// GetTargetClusterFromRequest is used on the agent side, it returns the name of the managed cluster the request
+// is meant for. It is empty if the request comes from a user-server which does not set it.
+func GetTargetClusterFromRequest(req *http.Request) string {
+	return req.Header.Get("Cluster-Proxy-Cluster")
+}
+
 // GetTargetServiceURLFromRequest is used on the agent side, the service-proxy agent recived a request from the proxy-agent, and need to know the target service URL to do further proxy.
 func GetTargetServiceURLFromRequest(req *http.Request) (*url.URL, error) {
 	// get proto, namespace, service, and port from request headers
@@ -133,6 +149,27 @@ func GetTargetServiceURLFromRequest(req *http.Request) (*url.URL, error) {
 	return url, nil
 }
 
+// GetClusterFromHost extrict the cluster from a host <cluster>.<domain>, the port of the host is ignored.
+// input: cluster1.proxy.hub.example.com:443, proxy.hub.example.com
+// output: cluster1, true
+// ok is false if the host is not a subdomain of the domain, the cluster is then the first segment of the request path.
+func GetClusterFromHost(host, domain string) (cluster string, ok bool, err error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	suffix := "." + strings.ToLower(strings.TrimSuffix(domain, "."))
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if !strings.HasSuffix(host, suffix) {
+		return "", false, nil
+	}
+
+	cluster = strings.TrimSuffix(host, suffix)
+	if errs := validation.IsDNS1123Label(cluster); len(errs) > 0 {
+		return "", true, fmt.Errorf("invalid cluster %q in the host %s: %s", cluster, host, strings.Join(errs, ", "))
+	}
+	return cluster, true, nil
+}
+
 const (
 	ProxyTypeService = iota
 	ProxyTypeKubeAPIServer
@@ -149,19 +186,35 @@ func GetProxyType(reqURI string) int {
 	return ProxyTypeKubeAPIServer
 }
 
-// ServeHealthProbes serves health probes and configchecker.
+// ServeHealthProbes serves health probes, configchecker and the prometheus metrics registered in the legacyregistry.
 func ServeHealthProbes(healthProbeBindAddress string, customChecks ...healthz.Checker) error {
+	return ServeProbes(healthProbeBindAddress, customChecks, nil)
+}
+
+// ServeProbes serves the liveness probe on /healthz, the readiness probe on /readyz, and the prometheus metrics
+// registered in the legacyregistry. The readiness probe fails until both the health checks and the ready checks pass.
+func ServeProbes(healthProbeBindAddress string, healthChecks, readyChecks []healthz.Checker) error {
 	mux := http.NewServeMux()
 
 	checks := map[string]healthz.Checker{
 		"healthz-ping": healthz.Ping,
 	}
 
-	for i, check := range customChecks {
+	for i, check := range healthChecks {
 		checks[fmt.Sprintf("custom-healthz-checker-%d", i)] = check
 	}
 
+	readyzChecks := map[string]healthz.Checker{}
+	for name, check := range checks {
+		readyzChecks[name] = check
+	}
+	for i, check := range readyChecks {
+		readyzChecks[fmt.Sprintf("custom-readyz-checker-%d", i)] = check
+	}
+
 	mux.Handle("/healthz", http.StripPrefix("/healthz", &healthz.Handler{Checks: checks}))
+	mux.Handle("/readyz", http.StripPrefix("/readyz", &healthz.Handler{Checks: readyzChecks}))
+	mux.Handle("/metrics", legacyregistry.Handler())
 	server := http.Server{
 		Handler:           mux,
 		ReadHeaderTimeout: 5 * time.Second,
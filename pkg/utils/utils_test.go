@@ -96,6 +96,61 @@ func TestGetProxyType(t *testing.T) {
 	}
 }
 
+func TestGetClusterFromHost(t *testing.T) {
+	testcases := []struct {
+		host      string
+		domain    string
+		cluster   string
+		ok        bool
+		expectErr bool
+	}{
+		{
+			host:    "cluster1.proxy.hub.example.com",
+			domain:  "proxy.hub.example.com",
+			cluster: "cluster1",
+			ok:      true,
+		},
+		{
+			host:    "Cluster1.Proxy.Hub.Example.com:443",
+			domain:  "proxy.hub.example.com",
+			cluster: "cluster1",
+			ok:      true,
+		},
+		{
+			host:    "1cluster.proxy.hub.example.com.",
+			domain:  "proxy.hub.example.com",
+			cluster: "1cluster",
+			ok:      true,
+		},
+		{
+			host:   "proxy.hub.example.com",
+			domain: "proxy.hub.example.com",
+			ok:     false,
+		},
+		{
+			host:   "cluster-proxy-user.apps.hub.example.com",
+			domain: "proxy.hub.example.com",
+			ok:     false,
+		},
+		{
+			host:      "a.cluster1.proxy.hub.example.com",
+			domain:    "proxy.hub.example.com",
+			ok:        true,
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range testcases {
+		cluster, ok, err := GetClusterFromHost(tc.host, tc.domain)
+		if tc.expectErr != (err != nil) {
+			t.Errorf("host %s: expected error %v, got %v", tc.host, tc.expectErr, err)
+		}
+		if cluster != tc.cluster || ok != tc.ok {
+			t.Errorf("host %s: expected %q %v, got %q %v", tc.host, tc.cluster, tc.ok, cluster, ok)
+		}
+	}
+}
+
 func TestParseServiceRequestURL(t *testing.T) {
 	testcases := []struct {
 		requestURL string
@@ -155,6 +210,32 @@ func TestParseServiceRequestURL(t *testing.T) {
 	}
 }
 
+func TestGetServicePathPrefix(t *testing.T) {
+	testcases := []struct {
+		requestURL string
+		expect     string
+	}{
+		{
+			requestURL: "/cluster1/api/v1/namespaces/default/services/https:grafana:3000/proxy-service/d/home?orgId=1",
+			expect:     "/cluster1/api/v1/namespaces/default/services/https:grafana:3000/proxy-service",
+		},
+		{
+			requestURL: "/cluster1/api/v1/namespaces/default/services/proxy-service/proxy-service",
+			expect:     "/cluster1/api/v1/namespaces/default/services/proxy-service/proxy-service",
+		},
+		{
+			requestURL: "/cluster1/api/pods",
+			expect:     "",
+		},
+	}
+
+	for _, tc := range testcases {
+		if actual := GetServicePathPrefix(tc.requestURL); actual != tc.expect {
+			t.Errorf("expected prefix: %v, got: %v", tc.expect, actual)
+		}
+	}
+}
+
 func TestUpdateRequest(t *testing.T) {
 	tsc := TargetServiceConfig{
 		Cluster:   "cluster1",
@@ -177,6 +258,7 @@ func TestUpdateRequest(t *testing.T) {
 			},
 			expect: &http.Request{
 				Header: map[string][]string{
+					"Cluster-Proxy-Cluster":   {"cluster1"},
 					"Cluster-Proxy-Proto":     {"https"},
 					"Cluster-Proxy-Port":      {"9091"},
 					"Cluster-Proxy-Namespace": {"default"},
@@ -191,6 +273,9 @@ func TestUpdateRequest(t *testing.T) {
 
 	for _, tc := range testcases {
 		actual := UpdateRequest(tsc, tc.req)
+		if GetTargetClusterFromRequest(actual) != tc.expect.Header.Get("Cluster-Proxy-Cluster") {
+			t.Errorf("expected cluster: %v, got: %v", tc.expect.Header.Get("Cluster-Proxy-Cluster"), GetTargetClusterFromRequest(actual))
+		}
 		if actual.Header.Get("Cluster-Proxy-Proto") != tc.expect.Header.Get("Cluster-Proxy-Proto") {
 			t.Errorf("expected proto: %v, got: %v", tc.expect.Header.Get("Cluster-Proxy-Proto"), actual.Header.Get("Cluster-Proxy-Proto"))
 		}
@@ -242,6 +327,7 @@ func TestGetTargetServiceURLFromRequest(t *testing.T) {
 			name: "other services",
 			req: &http.Request{
 				Header: map[string][]string{
+					"Cluster-Proxy-Cluster":   {"cluster1"},
 					"Cluster-Proxy-Proto":     {"https"},
 					"Cluster-Proxy-Port":      {"9091"},
 					"Cluster-Proxy-Service":   {"hello-world"},